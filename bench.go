@@ -0,0 +1,69 @@
+package parrot
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// requestTimings records how long each request to Polly took and how much
+// audio it returned, along with how long was spent waiting on the rate limit
+// beforehand, for --bench.
+type requestTimings struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	bytes     int64
+	rateWait  time.Duration
+}
+
+func (t *requestTimings) add(latency time.Duration, bytes int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.latencies = append(t.latencies, latency)
+	t.bytes += bytes
+}
+
+func (t *requestTimings) addRateWait(wait time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rateWait += wait
+}
+
+// waits returns the time spent waiting on the rate limit and in requests to
+// Polly, each summed over the workers.
+func (t *requestTimings) waits() (rateWait time.Duration, polly time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, latency := range t.latencies {
+		polly += latency
+	}
+	return t.rateWait, polly
+}
+
+// percentile returns the latency that p percent of requests took no longer
+// than, or 0 if there were none.
+func (t *requestTimings) percentile(p float64) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.latencies) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), t.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	// The nearest-rank method: the smallest latency with at least p percent
+	// of them at or below it.
+	rank := int(math.Ceil(float64(len(sorted))*p/100)) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// totals returns how many requests were made and how many bytes of audio they
+// returned.
+func (t *requestTimings) totals() (int, int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.latencies), t.bytes
+}
@@ -0,0 +1,139 @@
+package parrot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// languageScripts maps the first part of a language code to the Unicode
+// scripts its text is expected to be written in. Any language not listed is
+// expected to be written in Latin.
+var languageScripts = map[string][]string{
+	"ar":  {"Arabic"},
+	"arb": {"Arabic"},
+	"cmn": {"Han", "Latin"},
+	"hi":  {"Devanagari", "Latin"},
+	"ja":  {"Han", "Hiragana", "Katakana", "Latin"},
+	"ko":  {"Hangul", "Han", "Latin"},
+	"ru":  {"Cyrillic"},
+	"yue": {"Han", "Latin"},
+	"zh":  {"Han", "Latin"},
+}
+
+// maxReportedCharacters is how many distinct unsupported characters are named
+// for a row before the rest are only counted.
+const maxReportedCharacters = 5
+
+// characterSet is the characters expected in a row's text. Punctuation,
+// digits, spaces and combining marks, which Unicode puts in the Common and
+// Inherited scripts, are expected in every language, apart from control
+// characters other than tabs and line breaks, and the replacement character
+// that decoding leaves in place of bytes it couldn't read.
+type characterSet struct {
+	scripts []*unicode.RangeTable
+	extra   *unicode.RangeTable
+}
+
+// newCharacterSet returns the characters expected for language, in scripts if
+// any are given rather than those of the language, along with the characters
+// in ranges, a comma-separated list such as U+2010-U+2027,U+20AC.
+func newCharacterSet(language string, scripts []string, ranges string) (*characterSet, error) {
+	if len(scripts) == 0 {
+		code := strings.ToLower(strings.SplitN(language, "-", 2)[0])
+		scripts = languageScripts[code]
+		if scripts == nil {
+			scripts = []string{"Latin"}
+		}
+	}
+	set := &characterSet{}
+	for _, name := range append(scripts, "Common", "Inherited") {
+		table, ok := unicode.Scripts[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown Unicode script %q", name)
+		}
+		set.scripts = append(set.scripts, table)
+	}
+	extra, err := parseCharacterRanges(ranges)
+	if err != nil {
+		return nil, err
+	}
+	set.extra = extra
+	return set, nil
+}
+
+// parseCharacterRanges parses a comma-separated list of code points and
+// ranges of them, such as U+2010-U+2027,U+20AC.
+func parseCharacterRanges(ranges string) (*unicode.RangeTable, error) {
+	table := &unicode.RangeTable{}
+	for _, item := range strings.Split(ranges, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		bounds := strings.SplitN(item, "-", 2)
+		lo, err := parseCodePoint(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		hi := lo
+		if len(bounds) == 2 {
+			if hi, err = parseCodePoint(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+		if hi < lo {
+			return nil, fmt.Errorf("character range %q ends before it starts", item)
+		}
+		table.R32 = append(table.R32, unicode.Range32{Lo: uint32(lo), Hi: uint32(hi), Stride: 1})
+	}
+	return table, nil
+}
+
+func parseCodePoint(s string) (rune, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(strings.ToUpper(s), "U+") {
+		return 0, fmt.Errorf("character %q isn't written as U+ and a hex code point", s)
+	}
+	n, err := strconv.ParseUint(s[2:], 16, 32)
+	if err != nil || n > unicode.MaxRune {
+		return 0, fmt.Errorf("character %q isn't a valid code point", s)
+	}
+	return rune(n), nil
+}
+
+func (s *characterSet) contains(r rune) bool {
+	if unicode.Is(s.extra, r) {
+		return true
+	}
+	if r == unicode.ReplacementChar ||
+		(unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r') {
+		return false
+	}
+	return unicode.IsOneOf(s.scripts, r)
+}
+
+// unsupported returns a description of the characters in text that aren't in
+// the set, or "" if there are none.
+func (s *characterSet) unsupported(text string) string {
+	var found []string
+	seen := make(map[rune]bool)
+	for _, r := range text {
+		if seen[r] || s.contains(r) {
+			continue
+		}
+		seen[r] = true
+		if len(found) < maxReportedCharacters {
+			found = append(found, fmt.Sprintf("%q (U+%04X)", r, r))
+		}
+	}
+	if len(seen) == 0 {
+		return ""
+	}
+	description := strings.Join(found, ", ")
+	if more := len(seen) - len(found); more > 0 {
+		description += fmt.Sprintf(" and %d more", more)
+	}
+	return description
+}
@@ -0,0 +1,48 @@
+package parrot
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Clock is the time as the rate limiter and the waits between retries and
+// polls see it, so that a fake can stand in for it in tests. It satisfies
+// ratelimit.Clock.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	// After sends the time on the channel it returns once d has passed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the Clock used unless Config.Clock is set.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// sleepContext waits for d on clock, returning early with ctx's error if ctx
+// is done first.
+func sleepContext(ctx context.Context, clock Clock, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-clock.After(d):
+		return nil
+	}
+}
+
+// newJitter returns a function returning a random number in [0, n) from
+// source, which is safe to call from several goroutines at once.
+func newJitter(source rand.Source) func(n int64) int64 {
+	r := rand.New(source)
+	var mu sync.Mutex
+	return func(n int64) int64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return r.Int63n(n)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go-v2/service/polly"
+	"github.com/aws/aws-sdk-go-v2/service/polly/types"
+	"github.com/biesnecker/parrot-go"
+	"github.com/jessevdk/go-flags"
+)
+
+type opts struct {
+	parrot.Config
+
+	ConfigFile string `long:"config" description:"file of options to use, that flags given on the command line override: INI, with one name = value line per flag such as voice = Joanna, or JSON if its name ends in .json, with an object of flag names and values such as {\"voice\": \"Joanna\", \"input\": [\"a.csv\", \"b.csv\"]}" no-ini:"true"`
+
+	ListVoices bool `long:"list-voices" description:"list the available voices, limited to those that speak --language, are of --gender and support --engine if given, and exit"`
+
+	Gender string `long:"gender" description:"only list voices of this gender with --list-voices" choice:"female" choice:"male"`
+
+	ValidateOnly bool `long:"validate-only" description:"check every row of the input without calling AWS, report the problems found and exit"`
+
+	MaxErrors int `long:"max-errors" description:"report at most this many of the problems --validate-only finds, along with how many there were in all; 0 means no limit"`
+}
+
+const (
+	// exitFatal is the exit status used when a run can't start or can't
+	// carry on, such as for bad flags, files that can't be opened or AWS
+	// refusing the credentials.
+	exitFatal = 1
+
+	// exitRowsFailed is the exit status used when a run finishes but some of
+	// its rows failed, or when --validate-only finds problems.
+	exitRowsFailed = 2
+
+	// exitCostCeiling is the exit status used when --cost-ceiling or
+	// --max-total-chars stops a run.
+	exitCostCeiling = 3
+
+	// exitDeadline is the exit status used when --max-runtime stops a run.
+	exitDeadline = 4
+
+	// exitInterrupted is the exit status used when a signal stops a run.
+	exitInterrupted = 130
+)
+
+// exitWithError prints err on a line of its own, after what was being done
+// when it happened if stage isn't empty, and exits.
+func exitWithError(stage string, err error) {
+	if stage != "" {
+		fmt.Fprintf(os.Stderr, "parrot: %s: %v\n", stage, err)
+	} else {
+		fmt.Fprintf(os.Stderr, "parrot: %v\n", err)
+	}
+	os.Exit(exitFatal)
+}
+
+// readConfigFile parses the options in the file at path with ini, reading it
+// as JSON if its name ends in .json and as INI otherwise.
+func readConfigFile(ini *flags.IniParser, path string) error {
+	if !strings.EqualFold(filepath.Ext(path), ".json") {
+		return ini.ParseFile(path)
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	converted, err := jsonConfigToIni(contents)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	// The lines of the INI aren't the file's, so only the problem is given.
+	if err := ini.Parse(strings.NewReader(converted)); err != nil {
+		if iniErr, ok := err.(*flags.IniError); ok {
+			return fmt.Errorf("%s: %s", path, iniErr.Message)
+		}
+		return err
+	}
+	return nil
+}
+
+// jsonConfigToIni turns a JSON object of flag names and values into the INI
+// that would set them, with a line for each element of a value that's an
+// array.
+func jsonConfigToIni(contents []byte) (string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.UseNumber()
+	var values map[string]interface{}
+	if err := decoder.Decode(&values); err != nil {
+		return "", err
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var ini strings.Builder
+	for _, name := range names {
+		elements, ok := values[name].([]interface{})
+		if !ok {
+			elements = []interface{}{values[name]}
+		}
+		for _, element := range elements {
+			var value string
+			switch v := element.(type) {
+			case string:
+				value = strconv.Quote(v)
+			case json.Number:
+				value = v.String()
+			case bool:
+				value = strconv.FormatBool(v)
+			default:
+				return "", fmt.Errorf("%s must be a string, number, boolean or array of them", name)
+			}
+			fmt.Fprintf(&ini, "%s = %s\n", name, value)
+		}
+	}
+	return ini.String(), nil
+}
+
+func main() {
+	var options opts
+
+	var parser = flags.NewParser(&options, flags.Default)
+	parser.LongDescription = fmt.Sprintf(
+		"Exits with status 0 if every row was synthesized, %d if the run couldn't start or carry on, "+
+			"%d if some rows failed (listed in --error-output if given), "+
+			"%d if --cost-ceiling or --max-total-chars stopped it, %d if --max-runtime did "+
+			"and %d if it was interrupted.",
+		exitFatal,
+		exitRowsFailed,
+		exitCostCeiling,
+		exitDeadline,
+		exitInterrupted)
+	if _, err := parser.Parse(); err != nil {
+		if flagErr, ok := err.(*flags.Error); ok && flagErr.Type == flags.ErrHelp {
+			os.Exit(0)
+		}
+		os.Exit(exitFatal)
+	}
+	if options.ConfigFile != "" {
+		// Values from the file only fill in options the command line
+		// didn't set.
+		ini := flags.NewIniParser(parser)
+		ini.ParseAsDefaults = true
+		if err := readConfigFile(ini, options.ConfigFile); err != nil {
+			exitWithError("reading --config", err)
+		}
+	}
+
+	if options.ListVoices {
+		ctx := context.Background()
+		cfg, err := parrot.NewAWSConfig(ctx, &options.Config)
+		if err != nil {
+			exitWithError("loading the AWS configuration", err)
+		}
+		// --engine has a default, so voices are only limited to one that was
+		// asked for.
+		engine := ""
+		if opt := parser.FindOptionByLongName("engine"); (opt.IsSet() && !opt.IsSetDefault()) ||
+			options.Engine != string(types.EngineStandard) {
+			engine = options.Engine
+		}
+		if options.Neural {
+			engine = string(types.EngineNeural)
+		}
+		err = parrot.ListVoices(
+			ctx,
+			polly.NewFromConfig(cfg),
+			options.Language, options.Gender, engine, os.Stdout)
+		if err != nil {
+			exitWithError("listing voices", err)
+		}
+		return
+	}
+
+	// The first SIGINT or SIGTERM stops new work from starting and cancels
+	// in-flight requests; a second one kills the process as usual.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		signal.Stop(signals)
+		if !options.Quiet {
+			fmt.Fprintln(os.Stderr, "interrupted, stopping...")
+		}
+		cancel()
+	}()
+
+	if options.ValidateOnly {
+		problems, err := parrot.Validate(ctx, options.Config)
+		if err != nil {
+			exitWithError("validating", err)
+		}
+		shown := problems
+		if options.MaxErrors > 0 && len(shown) > options.MaxErrors {
+			shown = shown[:options.MaxErrors]
+		}
+		for _, problem := range shown {
+			fmt.Fprintln(os.Stderr, problem)
+		}
+		if len(shown) < len(problems) {
+			fmt.Fprintf(os.Stderr, "%d problems found, the first %d shown\n", len(problems), len(shown))
+			os.Exit(exitRowsFailed)
+		} else if len(problems) > 0 {
+			fmt.Fprintf(os.Stderr, "%d problems found\n", len(problems))
+			os.Exit(exitRowsFailed)
+		}
+		return
+	}
+
+	options.Log = os.Stderr
+	result, err := parrot.Run(ctx, options.Config)
+	if err != nil {
+		exitWithError("", err)
+	}
+
+	if len(result.Failures) > 0 {
+		os.Exit(exitRowsFailed)
+	}
+	if result.Interrupted {
+		os.Exit(exitInterrupted)
+	}
+	if result.CostCeilingReached || result.CharBudgetReached {
+		os.Exit(exitCostCeiling)
+	}
+	if result.DeadlineReached {
+		os.Exit(exitDeadline)
+	}
+}
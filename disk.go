@@ -0,0 +1,37 @@
+package parrot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// byteUnits maps the suffixes parseByteSize accepts to their sizes, longest
+// first so that "MiB" isn't taken for "B".
+var byteUnits = []struct {
+	suffix string
+	size   float64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+// parseByteSize parses a size such as 500MB, 1.5GiB or 1048576, whose units
+// are case-insensitive.
+func parseByteSize(s string) (uint64, error) {
+	number, size := strings.TrimSpace(s), 1.0
+	for _, unit := range byteUnits {
+		if len(number) > len(unit.suffix) &&
+			strings.EqualFold(number[len(number)-len(unit.suffix):], unit.suffix) {
+			number, size = strings.TrimSpace(number[:len(number)-len(unit.suffix)]), unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q isn't a size such as 500MB or 2GiB", s)
+	}
+	return uint64(n * size), nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package parrot
+
+import "errors"
+
+func freeDiskSpace(path string) (uint64, error) {
+	return 0, errors.New("--min-free-disk isn't supported on this system")
+}
@@ -3,8 +3,15 @@ module github.com/biesnecker/parrot-go
 go 1.15
 
 require (
-	github.com/aws/aws-sdk-go v1.37.24
+	github.com/aws/aws-sdk-go-v2 v1.2.0
 	github.com/aws/aws-sdk-go-v2/config v1.1.1
+	github.com/aws/aws-sdk-go-v2/credentials v1.1.1
+	github.com/aws/aws-sdk-go-v2/feature/s3/manager v1.0.2
+	github.com/aws/aws-sdk-go-v2/service/polly v1.1.1
+	github.com/aws/aws-sdk-go-v2/service/s3 v1.2.0
+	github.com/aws/aws-sdk-go-v2/service/sts v1.1.1
+	github.com/aws/smithy-go v1.1.0
 	github.com/jessevdk/go-flags v1.4.0
 	go.uber.org/ratelimit v0.2.0
+	golang.org/x/text v0.3.3
 )
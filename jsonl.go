@@ -0,0 +1,172 @@
+package parrot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// JSONLReadOptions is how ReadJSONLFile reads JSONL.
+type JSONLReadOptions struct {
+	// Gzipped input is decompressed, as is input whose name ends in .gz.
+	Gzipped bool
+	// AllowBlank skips blank lines, rather than failing them.
+	AllowBlank bool
+	// KeepGoing sends a line that can't be read as a record with its err set,
+	// rather than ending the read.
+	KeepGoing bool
+}
+
+// ReadJSONLFile reads the file at path, or stdin if isStdio(path), as one JSON
+// object per line as format says, and sends them to records as if they were
+// CSV: first a record of the first object's field names, then a record of
+// each object's values in the same order, numbered by the line they're on.
+// Every line must hold an object with the same fields as the first one, unless
+// format allows blank lines. It closes records once the file is exhausted, ctx
+// is done or an error occurs.
+func ReadJSONLFile(ctx context.Context, path string, format JSONLReadOptions, records chan<- CSVRecord) error {
+	defer close(records)
+
+	inputfile, err := openInput(path, format.Gzipped)
+	if err != nil {
+		return err
+	}
+	defer inputfile.Close()
+	reader := skipBOM(inputfile)
+
+	send := func(r CSVRecord) error {
+		select {
+		case records <- r:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	var fields []string
+	var fieldIndex map[string]int
+	for lineNo := 1; ; lineNo++ {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+		if strings.TrimSpace(line) == "" && format.AllowBlank {
+			continue
+		}
+		keys, record, err := jsonlRecord(line, fields, fieldIndex)
+		if err != nil && format.KeepGoing {
+			if err := send(CSVRecord{lineNo: lineNo, err: err}); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return fmt.Errorf("line %d: %w", lineNo, err)
+		}
+
+		// The first object's fields are sent as a header, and every object
+		// after it must have the same ones.
+		if fields == nil {
+			fields = keys
+			fieldIndex = make(map[string]int, len(fields))
+			for i, key := range fields {
+				fieldIndex[key] = i
+			}
+			if err := send(CSVRecord{lineNo: 0, record: fields}); err != nil {
+				return err
+			}
+		}
+		if err := send(CSVRecord{lineNo: lineNo, record: record, width: len(record)}); err != nil {
+			return err
+		}
+	}
+}
+
+// jsonlRecord returns the keys of the object on line and its values in the
+// order of fields, checking that it has just those fields. If fields is nil,
+// its values are returned in the order of its keys.
+func jsonlRecord(
+	line string,
+	fields []string,
+	fieldIndex map[string]int,
+) ([]string, []string, error) {
+	if strings.TrimSpace(line) == "" {
+		return nil, nil, errors.New("empty record")
+	}
+	keys, values, err := parseJSONObject([]byte(line))
+	if err != nil {
+		return nil, nil, err
+	}
+	if fields == nil {
+		return keys, values, nil
+	}
+	if len(keys) != len(fields) {
+		return nil, nil, fmt.Errorf(
+			"expected %d fields but found %d fields",
+			len(fields),
+			len(keys))
+	}
+	record := make([]string, len(fields))
+	for i, key := range keys {
+		index, ok := fieldIndex[key]
+		if !ok {
+			return nil, nil, fmt.Errorf("unexpected field %q", key)
+		}
+		record[index] = values[i]
+	}
+	return keys, record, nil
+}
+
+// parseJSONObject returns the keys of the JSON object in data, in the order
+// they appear, along with their values. String values are unquoted, null
+// becomes an empty string and anything else is left as JSON.
+func parseJSONObject(data []byte) ([]string, []string, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if tok, err := dec.Token(); err != nil {
+		return nil, nil, err
+	} else if tok != json.Delim('{') {
+		return nil, nil, errors.New("expected a JSON object")
+	}
+
+	var keys, values []string
+	seen := make(map[string]bool)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		key := tok.(string)
+		if seen[key] {
+			return nil, nil, fmt.Errorf("duplicate field %q", key)
+		}
+		seen[key] = true
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, nil, err
+		}
+		value := string(raw)
+		if value == "null" {
+			value = ""
+		} else if raw[0] == '"' {
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return nil, nil, err
+			}
+		}
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, nil, errors.New("unexpected data after the JSON object")
+	}
+	return keys, values, nil
+}
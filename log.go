@@ -0,0 +1,167 @@
+package parrot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+// logLevel is how much is written to stderr while parrot runs.
+type logLevel int
+
+const (
+	// logQuiet writes nothing but fatal errors.
+	logQuiet logLevel = iota
+	// logNormal adds the summary written at the end of a run.
+	logNormal
+	// logInfo adds what's done with each row that needs work.
+	logInfo
+	// logDebug adds the rows that need no work.
+	logDebug
+)
+
+// logger writes messages at or below its level, one per line. It's safe to
+// use from several goroutines at once.
+type logger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level logLevel
+}
+
+func newLogger(w io.Writer, level logLevel) *logger {
+	return &logger{w: w, level: level}
+}
+
+// logf writes a message at level.
+func (l *logger) logf(level logLevel, format string, args ...interface{}) {
+	if level > l.level {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(l.w, format+"\n", args...)
+}
+
+// rowf writes a message at level about the row read from lineNo, as
+// key=value pairs. voice is left out if it's empty.
+func (l *logger) rowf(
+	level logLevel,
+	lineNo int,
+	voice string,
+	format string,
+	args ...interface{},
+) {
+	if level > l.level {
+		return
+	}
+	name := "info"
+	if level == logDebug {
+		name = "debug"
+	}
+	line := fmt.Sprintf(
+		"time=%s level=%s line=%d",
+		time.Now().UTC().Format(time.RFC3339),
+		name,
+		lineNo)
+	if voice != "" {
+		line += " voice=" + voice
+	}
+	l.logf(level, "%s msg=%s", line, strconv.Quote(fmt.Sprintf(format, args...)))
+}
+
+// Stages of a run that an error written to --json-errors can come from.
+const (
+	// stageFatal is an error that stopped the run from starting or carrying
+	// on.
+	stageFatal = "fatal"
+	// stageInput is a row that couldn't be read or prepared for synthesis.
+	stageInput = "input"
+	// stageSynthesize is a row that failed while being synthesized or
+	// written.
+	stageSynthesize = "synthesize"
+)
+
+// jsonError is an error as written to --json-errors. Line, Input and Text are
+// left out for errors that aren't about a row, and Code is left out if the
+// error has none.
+type jsonError struct {
+	Input   string `json:"input,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Text    string `json:"text,omitempty"`
+	Stage   string `json:"stage"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+// jsonErrorWriter writes errors as JSON objects, one per line. It's safe to
+// use from several goroutines at once.
+type jsonErrorWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+func newJSONErrorWriter(w io.Writer) *jsonErrorWriter {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &jsonErrorWriter{enc: enc}
+}
+
+// writeRow writes the failure of a row.
+func (w *jsonErrorWriter) writeRow(e rowError) {
+	stage := e.stage
+	if stage == "" {
+		stage = stageInput
+	}
+	w.write(jsonError{
+		Input:   e.input,
+		Line:    e.lineNo,
+		Text:    e.text,
+		Stage:   stage,
+		Code:    errorCode(e.err),
+		Message: e.err.Error(),
+	})
+}
+
+// writeFatal writes an error that stopped the run.
+func (w *jsonErrorWriter) writeFatal(err error) {
+	w.write(jsonError{Stage: stageFatal, Code: errorCode(err), Message: err.Error()})
+}
+
+// write writes e, keeping the first error it gets for Error to return.
+func (w *jsonErrorWriter) write(e jsonError) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.enc.Encode(e); err != nil && w.err == nil {
+		w.err = err
+	}
+}
+
+// Error returns the first error writing failed with, if any.
+func (w *jsonErrorWriter) Error() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// errorCode returns the code of the AWS error err wraps, such as
+// ThrottlingException, or one of parrot's own for the failures it detects
+// itself, or "" if it has none.
+func errorCode(err error) string {
+	var apiErr smithy.APIError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr.ErrorCode()
+	case errors.Is(err, errRequestTimeout):
+		return "RequestTimeout"
+	case errors.Is(err, errEmptyAudio):
+		return "EmptyAudio"
+	}
+	return ""
+}
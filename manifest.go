@@ -0,0 +1,151 @@
+package parrot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/polly/types"
+)
+
+// manifestEntry describes one audio file written for a row, for --manifest.
+type manifestEntry struct {
+	Text     string `json:"text"`
+	Voice    string `json:"voice"`
+	Engine   string `json:"engine"`
+	Language string `json:"language"`
+	File     string `json:"file"`
+	Bytes    int64  `json:"bytes"`
+	// Characters is how many characters Polly billed for the file in this
+	// run, which is zero if it was already there.
+	Characters int64     `json:"characters"`
+	Timestamp  time.Time `json:"timestamp"`
+	// RequestIDs are the IDs of the requests the file was made from, with
+	// --request-ids.
+	RequestIDs []string `json:"request_ids,omitempty"`
+
+	path string
+	// row is the row the file was fetched for, or nil if it was already
+	// there.
+	row *pendingRow
+}
+
+// writeManifest writes entries whose rows were written to the output to path
+// as a JSON array, taking each file's size and timestamp from the file
+// itself. With appendTo set, the entries are merged into the manifest already
+// at path, if there is one, replacing those for the same files.
+func writeManifest(path string, entries []*manifestEntry, appendTo bool) error {
+	var written []*manifestEntry
+	if appendTo {
+		var err error
+		if written, err = readManifest(path); err != nil {
+			return err
+		}
+	}
+	index := make(map[string]int, len(written))
+	for i, entry := range written {
+		index[entry.File] = i
+	}
+	for _, entry := range entries {
+		if entry.row != nil && entry.row.err != nil {
+			continue
+		}
+		info, err := os.Stat(entry.path)
+		if err != nil {
+			return err
+		}
+		entry.Bytes = info.Size()
+		entry.Timestamp = info.ModTime().UTC()
+		if i, ok := index[entry.File]; ok {
+			// A file that was already there keeps what the run that made
+			// it recorded, such as the characters it was billed.
+			if entry.row == nil {
+				written[i].Bytes, written[i].Timestamp = entry.Bytes, entry.Timestamp
+			} else {
+				written[i] = entry
+			}
+			continue
+		}
+		index[entry.File] = len(written)
+		written = append(written, entry)
+	}
+	if written == nil {
+		written = []*manifestEntry{}
+	}
+	return writeFile(path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(written)
+	})
+}
+
+// readManifest returns the entries of the manifest at path, or none if there
+// isn't one.
+func readManifest(path string) ([]*manifestEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var entries []*manifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return entries, nil
+}
+
+// writePlaylist writes the files of entries whose rows were written to the
+// output to path as an extended M3U playlist, titled with their text. Files
+// are given relative to the playlist, so that it can be moved along with the
+// audio, and with their durations if they're MP3s.
+func writePlaylist(path string, entries []*manifestEntry, format string) error {
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	return writeFile(path, func(w io.Writer) error {
+		if _, err := io.WriteString(w, "#EXTM3U\n"); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.row != nil && entry.row.err != nil {
+				continue
+			}
+			// -1 is how M3U says the duration isn't known.
+			seconds := -1.0
+			if format == string(types.OutputFormatMp3) {
+				audio, err := ioutil.ReadFile(entry.path)
+				if err != nil {
+					return err
+				}
+				if duration := mp3Duration(audio); duration > 0 {
+					seconds = math.Ceil(duration)
+				}
+			}
+			file, err := filepath.Abs(entry.path)
+			if err != nil {
+				return err
+			}
+			if rel, err := filepath.Rel(dir, file); err == nil {
+				file = rel
+			}
+			title := strings.Join(strings.Fields(entry.Text), " ")
+			_, err = fmt.Fprintf(w, "#EXTINF:%d,%s - %s\n%s\n",
+				int64(seconds),
+				entry.Voice,
+				title,
+				filepath.ToSlash(file))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,180 @@
+package parrot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/service/polly/types"
+)
+
+// audioMeta is what's written to an audio file's .meta.json file with
+// --write-meta.
+type audioMeta struct {
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+	// DurationSeconds is estimated from the frame headers of MP3 audio, and
+	// left out for other formats.
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+}
+
+// writeAudioMeta writes the metadata of the audio file at audioPath, in
+// format, to metaPath, returning the audio's size.
+func writeAudioMeta(audioPath string, metaPath string, format string) (int64, error) {
+	audio, err := ioutil.ReadFile(audioPath)
+	if err != nil {
+		return 0, err
+	}
+	sum := sha256.Sum256(audio)
+	meta := audioMeta{Bytes: int64(len(audio)), SHA256: hex.EncodeToString(sum[:])}
+	if format == string(types.OutputFormatMp3) {
+		meta.DurationSeconds = mp3Duration(audio)
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	err = writeFile(metaPath, func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	})
+	return meta.Bytes, err
+}
+
+// cachedAudioSize returns the size of the existing audio file at audioPath,
+// writing its metadata to metaPath first if that hasn't been done.
+func cachedAudioSize(audioPath string, metaPath string, format string) (int64, error) {
+	if missing, err := fileMissing(metaPath); err != nil {
+		return 0, err
+	} else if missing {
+		return writeAudioMeta(audioPath, metaPath, format)
+	}
+	info, err := os.Stat(audioPath)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// checkAudioChecksum reports whether the audio file at audioPath still has the
+// SHA-256 checksum recorded in its meta file at metaPath. A file without a
+// meta file, or whose meta file predates checksums, can't be checked and
+// passes.
+func checkAudioChecksum(audioPath string, metaPath string) (bool, error) {
+	data, err := ioutil.ReadFile(metaPath)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	var meta audioMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return false, fmt.Errorf("reading %s: %w", metaPath, err)
+	}
+	if meta.SHA256 == "" {
+		return true, nil
+	}
+	audio, err := ioutil.ReadFile(audioPath)
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(audio)
+	return hex.EncodeToString(sum[:]) == meta.SHA256, nil
+}
+
+// mp3Bitrates holds the Layer III bitrates in kbit/s by bitrate index, for
+// MPEG-1 and then for MPEG-2 and 2.5.
+var mp3Bitrates = [2][16]int{
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+}
+
+// mp3SampleRates holds the sample rates in Hz by sample rate index, for
+// MPEG-1, MPEG-2 and MPEG-2.5.
+var mp3SampleRates = [3][3]int{
+	{44100, 48000, 32000},
+	{22050, 24000, 16000},
+	{11025, 12000, 8000},
+}
+
+// mp3Duration returns the length in seconds, to the millisecond, of the MPEG
+// Layer III audio in data by adding up its frames, stopping at the first thing
+// that isn't one.
+func mp3Duration(data []byte) float64 {
+	// Skip an ID3v2 tag, whose size is stored as four 7-bit bytes.
+	if len(data) >= 10 && string(data[:3]) == "ID3" {
+		size := int(data[6])<<21 | int(data[7])<<14 | int(data[8])<<7 | int(data[9])
+		if 10+size > len(data) {
+			return 0
+		}
+		data = data[10+size:]
+	}
+
+	seconds := 0.0
+	for len(data) >= 4 {
+		if data[0] != 0xff || data[1]&0xe0 != 0xe0 {
+			break
+		}
+		version := (data[1] >> 3) & 0x3
+		layer := (data[1] >> 1) & 0x3
+		bitrateIndex := data[2] >> 4
+		sampleRateIndex := (data[2] >> 2) & 0x3
+		padding := int(data[2]>>1) & 0x1
+		if version == 1 || layer != 1 || sampleRateIndex == 3 {
+			// A reserved version, a layer other than III or a reserved rate.
+			break
+		}
+
+		// Version 3 is MPEG-1, 2 is MPEG-2 and 0 is MPEG-2.5.
+		mpeg1 := version == 3
+		rates, samples, slots := 1, 576, 72
+		if mpeg1 {
+			rates, samples, slots = 0, 1152, 144
+		}
+		sampleRates := mp3SampleRates[1]
+		if mpeg1 {
+			sampleRates = mp3SampleRates[0]
+		} else if version == 0 {
+			sampleRates = mp3SampleRates[2]
+		}
+		bitrate := mp3Bitrates[rates][bitrateIndex] * 1000
+		sampleRate := sampleRates[sampleRateIndex]
+		if bitrate == 0 {
+			break
+		}
+
+		frameLen := slots*bitrate/sampleRate + padding
+		if frameLen > len(data) {
+			break
+		}
+		seconds += float64(samples) / float64(sampleRate)
+		data = data[frameLen:]
+	}
+	return math.Round(seconds*1000) / 1000
+}
+
+// chunkBoundary is where the audio of one request for a split text is in its
+// audio file, as written to its .chunks.json file with --chunk-boundaries.
+type chunkBoundary struct {
+	Text      string `json:"text"`
+	StartByte int64  `json:"start_byte"`
+	EndByte   int64  `json:"end_byte"`
+	// DurationSeconds is only estimated for MP3 audio.
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+}
+
+func writeChunkBoundaries(path string, boundaries []chunkBoundary) error {
+	data, err := json.MarshalIndent(boundaries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	})
+}
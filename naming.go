@@ -0,0 +1,205 @@
+package parrot
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// audioNamer picks the base filename, without an extension, of each row's
+// audio. The hash schemes name audio after its text, so the same text always
+// gets the same file. The column and sequential schemes don't, so a name
+// that's already been given to other text has a suffix added. The filename
+// scheme uses a column's value as it is, so it's an error for two texts to
+// have the same one.
+type audioNamer struct {
+	scheme string
+	// column is the column the column and filename schemes name audio after,
+	// and -1 for every other scheme.
+	column int
+	used   map[string]string
+}
+
+// newAudioNamer returns a namer for naming, which is sha1, md5, sha256,
+// sequential or column:N, where N is a column index or, if there's a header,
+// one of its names. If filenameColumn is set, it's the column of the
+// filename scheme, which takes the place of naming.
+func newAudioNamer(naming string, filenameColumn string, header []string) (*audioNamer, error) {
+	n := &audioNamer{scheme: naming, column: -1, used: make(map[string]string)}
+	if filenameColumn != "" {
+		column, err := resolveColumn(filenameColumn, header)
+		if err != nil {
+			return nil, fmt.Errorf("--filename-column: %w", err)
+		}
+		n.scheme = "filename"
+		n.column = column
+		return n, nil
+	}
+	switch {
+	case naming == "sha1" || naming == "md5" || naming == "sha256" ||
+		naming == "sequential":
+	case strings.HasPrefix(naming, "column:"):
+		n.scheme = "column"
+		column, err := resolveColumn(strings.TrimPrefix(naming, "column:"), header)
+		if err != nil {
+			return nil, fmt.Errorf("--naming: %w", err)
+		}
+		if column < 0 {
+			return nil, fmt.Errorf("--naming %s needs a column", naming)
+		}
+		n.column = column
+	default:
+		return nil, fmt.Errorf("unknown --naming scheme %q", naming)
+	}
+	return n, nil
+}
+
+// name returns the base filename in dir for the audio of text, found in
+// record, the rowNo'th data row of the input.
+func (n *audioNamer) name(text string, record []string, rowNo int, dir string) (string, error) {
+	var h hash.Hash
+	switch n.scheme {
+	case "sha1":
+		h = sha1.New()
+	case "md5":
+		h = md5.New()
+	case "sha256":
+		h = sha256.New()
+	}
+	if h != nil {
+		h.Write([]byte(text))
+		return fmt.Sprintf("%x", h.Sum(nil)), nil
+	}
+
+	if n.scheme == "filename" {
+		name, err := sanitizeFilename(record[n.column])
+		if err != nil {
+			return "", err
+		}
+		key := filepath.Join(dir, name)
+		if usedBy, ok := n.used[key]; ok && usedBy != text {
+			return "", fmt.Errorf("filename %q is already used for %q", name, usedBy)
+		}
+		n.used[key] = text
+		return name, nil
+	}
+
+	base := fmt.Sprintf("%05d", rowNo)
+	if n.scheme == "column" {
+		base = slugify(record[n.column])
+	}
+	name := base
+	for suffix := 2; ; suffix++ {
+		key := filepath.Join(dir, name)
+		if usedBy, ok := n.used[key]; !ok || usedBy == text {
+			n.used[key] = text
+			return name, nil
+		}
+		name = fmt.Sprintf("%s-%d", base, suffix)
+	}
+}
+
+// synthesisParams returns what, besides its text, audio is synthesized with,
+// to be hashed along with the text with --hash-params. Each value is put after
+// a NUL, which text read as UTF-8 can't be confused with.
+func synthesisParams(voice, engine, language, format, sampleRate string) string {
+	return "\x00" + strings.Join([]string{voice, engine, language, format, sampleRate}, "\x00")
+}
+
+// synthesisKey returns text along with the language and voices it's
+// synthesized in, which tells apart rows whose text is the same but whose
+// audio isn't.
+func synthesisKey(text, language string, voices []string) string {
+	return text + "\x00" + language + "\x00" + strings.Join(voices, "\x00")
+}
+
+// rowNameText returns what the audio of text is named after for a row in
+// language and voices. A row given its own voice or language by a column is
+// named after them along with its text, so that its audio isn't taken for that
+// of the same text in the default voices and language; partitions already keep
+// languages apart.
+func rowNameText(
+	text string,
+	language string,
+	voices []string,
+	defaultLanguage string,
+	defaultVoices []string,
+	partitioned bool,
+) string {
+	var nameLanguage string
+	var nameVoices []string
+	if language != defaultLanguage && !partitioned {
+		nameLanguage = language
+	}
+	if !equalStrings(voices, defaultVoices) {
+		nameVoices = voices
+	}
+	if nameLanguage == "" && nameVoices == nil {
+		return text
+	}
+	return synthesisKey(text, nameLanguage, nameVoices)
+}
+
+// hashed reports whether the namer names audio after a hash of its text.
+func (n *audioNamer) hashed() bool {
+	return n.scheme == "sha1" || n.scheme == "md5" || n.scheme == "sha256"
+}
+
+// shardDir returns the slash-separated directory that name is nested in with
+// depth levels of sharding, taking two characters of name for each, such as
+// ab/cd for abcdef and a depth of 2.
+func shardDir(name string, depth int) string {
+	dir := ""
+	for i := 0; i < depth && 2*i+2 <= len(name); i++ {
+		dir = path.Join(dir, name[2*i:2*i+2])
+	}
+	return dir
+}
+
+// sanitizeFilename returns s as a filename, with characters that some
+// filesystems don't allow replaced with underscores. It's an error for s to be
+// empty or to name another directory.
+func sanitizeFilename(s string) (string, error) {
+	trimmed := strings.TrimSpace(s)
+	if trimmed == "" {
+		return "", errors.New("filename is empty")
+	}
+	if trimmed == "." || trimmed == ".." || strings.ContainsAny(trimmed, `/\`) {
+		return "", fmt.Errorf("filename %q can't name a directory", s)
+	}
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, trimmed), nil
+}
+
+// slugify makes a filename out of s from its lowercased letters and digits,
+// with a dash in place of everything in between.
+func slugify(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	if b.Len() == 0 {
+		return "untitled"
+	}
+	return b.String()
+}
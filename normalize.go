@@ -0,0 +1,28 @@
+package parrot
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// normalizeText trims text, collapses each run of whitespace inside it to a
+// single space and puts it in Unicode normal form C, so that text differing
+// only in those ways is treated as the same. If lowercase is set, it's also
+// lowercased.
+func normalizeText(text string, lowercase bool) string {
+	text = strings.Join(strings.Fields(norm.NFC.String(text)), " ")
+	if lowercase {
+		text = strings.ToLower(text)
+	}
+	return text
+}
+
+// trimKey trims whitespace from the ends of text, along with any byte order
+// marks left there, which is all --trim-key does.
+func trimKey(text string) string {
+	return strings.TrimFunc(text, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '\uFEFF'
+	})
+}
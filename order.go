@@ -0,0 +1,171 @@
+package parrot
+
+import (
+	"context"
+	"sort"
+	"unicode/utf8"
+)
+
+// outputReorderWindow is how many rows can be waiting to be written, behind a
+// row whose audio hasn't been fetched yet, before reading more input blocks.
+const outputReorderWindow = 4096
+
+// rowOrderer puts output rows back into the order they were read in, however
+// out of order their audio finishes fetching. Every row that is to be written
+// reserves a place in line, and is then delivered exactly once, even if it
+// turns out it shouldn't be written after all.
+type rowOrderer struct {
+	rows    chan orderedRow
+	slots   chan struct{}
+	nextSeq int
+	// placed is the place in line set by place, and reserved is whether
+	// it's been taken, when rows are handled out of order.
+	placing  bool
+	placed   int
+	reserved bool
+	done     chan struct{}
+}
+
+type orderedRow struct {
+	seq    int
+	record CSVRecord
+	// output is where the record is written, or nil to write nothing.
+	output chan<- CSVRecord
+}
+
+// newRowOrderer returns an orderer that lets up to window rows wait, or any
+// number if window is 0.
+func newRowOrderer(window int) *rowOrderer {
+	o := &rowOrderer{
+		rows: make(chan orderedRow),
+		done: make(chan struct{}),
+	}
+	if window > 0 {
+		o.slots = make(chan struct{}, window)
+	}
+	go o.run()
+	return o
+}
+
+// reserve returns the next place in line, blocking while the window is full,
+// or the place set by place. It must only be called from one goroutine.
+func (o *rowOrderer) reserve() int {
+	if o.placing {
+		o.reserved = true
+		return o.placed
+	}
+	if o.slots != nil {
+		o.slots <- struct{}{}
+	}
+	seq := o.nextSeq
+	o.nextSeq++
+	return seq
+}
+
+// place sets the place in line that the next row reserves, for rows handled
+// in a different order from the one they're written in, each of which then
+// has its place set exactly once. A row that doesn't reserve its place before
+// the next row's is set, or before close, is left out. It's only for an
+// orderer without a window, and must be called from the goroutine that calls
+// reserve.
+func (o *rowOrderer) place(seq int) {
+	o.skipUnreserved()
+	o.placing = true
+	o.placed = seq
+	o.reserved = false
+}
+
+func (o *rowOrderer) skipUnreserved() {
+	if o.placing && !o.reserved {
+		o.deliver(o.placed, CSVRecord{}, nil)
+		o.reserved = true
+	}
+}
+
+// deliver hands over the row reserved as seq, to be sent to output once every
+// row before it has been. A nil output drops the row.
+func (o *rowOrderer) deliver(seq int, record CSVRecord, output chan<- CSVRecord) {
+	o.rows <- orderedRow{seq: seq, record: record, output: output}
+}
+
+func (o *rowOrderer) run() {
+	waiting := make(map[int]orderedRow)
+	next := 0
+	for row := range o.rows {
+		waiting[row.seq] = row
+		for {
+			ready, ok := waiting[next]
+			if !ok {
+				break
+			}
+			delete(waiting, next)
+			if ready.output != nil {
+				ready.output <- ready.record
+			}
+			if o.slots != nil {
+				<-o.slots
+			}
+			next++
+		}
+	}
+	close(o.done)
+}
+
+// close waits for every delivered row to be sent on. Nothing may be reserved
+// or delivered afterwards.
+func (o *rowOrderer) close() {
+	o.skipUnreserved()
+	close(o.rows)
+	<-o.done
+}
+
+// reorderRecords sends the records from in on to out in the order named by
+// --order, with each one's seq set to its place in the order they were read.
+// Every record is held in memory until in is closed, as any of them might
+// come first. Records are ordered by the length of their text in column, and
+// shuffled with jitter. It closes out once it's done, or once ctx is.
+func reorderRecords(
+	ctx context.Context,
+	order string,
+	column int,
+	jitter func(n int64) int64,
+	in <-chan CSVRecord,
+	out chan<- CSVRecord,
+) {
+	defer close(out)
+	var records []CSVRecord
+	for r := range in {
+		r.seq = len(records)
+		records = append(records, r)
+	}
+
+	textLen := func(r CSVRecord) int {
+		if column >= len(r.record) {
+			return 0
+		}
+		return utf8.RuneCountInString(r.record[column])
+	}
+	switch order {
+	case "shuffle":
+		for i := len(records) - 1; i > 0; i-- {
+			j := int(jitter(int64(i + 1)))
+			records[i], records[j] = records[j], records[i]
+		}
+	case "shortest-first":
+		sort.SliceStable(records, func(i, j int) bool {
+			return textLen(records[i]) < textLen(records[j])
+		})
+	case "longest-first":
+		sort.SliceStable(records, func(i, j int) bool {
+			return textLen(records[i]) > textLen(records[j])
+		})
+	}
+
+	for _, r := range records {
+		select {
+		case out <- r:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
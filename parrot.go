@@ -1,207 +1,3687 @@
-package main
+// Package parrot synthesizes speech for each row of a CSV file with Amazon
+// Polly, writing the audio to files and the rows, with their filenames, to an
+// output CSV.
+package parrot
 
 import (
-	"crypto/sha1"
+	"bytes"
+	"context"
 	"encoding/csv"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"mime"
+	"net"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/polly"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/polly"
+	"github.com/aws/aws-sdk-go-v2/service/polly/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 	"github.com/jessevdk/go-flags"
 	"go.uber.org/ratelimit"
+	"golang.org/x/text/encoding"
 )
 
-type opts struct {
-	Input string `short:"i" long:"input" description:"path to input file" required:"true"`
+// Version is parrot's version, which is added to the User-Agent of its AWS
+// requests. Builds set it with -ldflags "-X
+// github.com/biesnecker/parrot-go.Version=...".
+var Version = "dev"
 
-	Output string `short:"o" long:"output" description:"path to output file" required:"true"`
+// Config configures a run. Its fields mirror the command line flags, whose
+// tags they carry, and DefaultConfig returns it with the flags' defaults.
+type Config struct {
+	Input []string `short:"i" long:"input" description:"path to input file, or - for stdin; may be a glob or given more than once to read several files as one input"`
 
-	AudioOut string `short:"a" long:"audio-out" description:"path to the audio output directory" required:"true"`
+	Output string `short:"o" long:"output" description:"path to output file, or - for stdout"`
 
-	Language string `short:"l" long:"language" description:"language code for input text" required:"true"`
+	OutputRotateRows int `long:"output-rotate-rows" description:"write the output as numbered parts, such as out.0001.csv and out.0002.csv, of at most this many rows each, each with the header if there is one"`
 
-	Voice string `short:"v" long:"voice" description:"AWS Polly voice to use" required:"true"`
+	OutputRotateBytes string `long:"output-rotate-bytes" description:"write the output as numbered parts of at most this much CSV each, before any gzipping, such as 100MB"`
 
-	Neural bool `short:"n" long:"neural" description:"Use neural voice"`
+	AudioOut string `short:"a" long:"audio-out" description:"path to the audio output directory (required unless --list-voices or --audio-s3 is set)"`
+
+	MinFreeDisk string `long:"min-free-disk" description:"stop the run, keeping the output written so far, once the filesystem of --audio-out has less than this much space free, such as 500MB or 2GiB"`
+
+	Mkdir bool `long:"mkdir" description:"create --audio-out, along with any missing parents, if it doesn't exist"`
+
+	AudioS3 string `long:"audio-s3" description:"s3://bucket/prefix to upload audio files to instead of writing them to --audio-out, writing their URIs to the output"`
+
+	S3ListExisting bool `long:"s3-list-existing" description:"list the objects under --audio-s3 once at the start to tell which audio files already exist, instead of checking each row's with a request"`
+
+	Language string `short:"l" long:"language" description:"language code for input text (required unless --language-column is set)"`
+
+	Voice string `short:"v" long:"voice" description:"AWS Polly voice to use (required unless --compare-voices or --voice-column is set)"`
+
+	Engine string `short:"e" long:"engine" description:"Polly engine to use" choice:"standard" choice:"neural" choice:"long-form" choice:"generative" default:"standard"`
+
+	VoiceEngineFallback bool `long:"voice-engine-fallback" description:"synthesize with the standard engine when Polly says a voice doesn't support --engine, rather than failing the row, adding an engine column after each audio column with the engine new audio was made with"`
+
+	EmitVoice bool `long:"emit-voice" description:"add a voice column after each audio column with the voice its audio is made with"`
+
+	EmitEngine bool `long:"emit-engine" description:"add an engine column after each audio column with the engine its audio is made with, which --voice-engine-fallback adds anyway but leaves empty for audio that already existed"`
+
+	Neural bool `short:"n" long:"neural" description:"Use neural voice (deprecated, use --engine neural)"`
 
 	Region string `short:"r" long:"region" description:"The AWS region to call" default:"us-west-2"`
+
+	Profile string `long:"profile" description:"named AWS profile to take credentials from, instead of the default credential chain"`
+
+	AssumeRoleARN string `long:"assume-role-arn" description:"ARN of a role to assume, using the --profile or default credentials, before calling Polly"`
+
+	ExternalID string `long:"external-id" description:"external ID to give when assuming --assume-role-arn"`
+
+	Endpoint string `long:"endpoint" description:"URL to send AWS requests to instead of the real service, such as http://localhost:4566 for LocalStack"`
+
+	UserAgent string `long:"user-agent" description:"text added to the User-Agent of the AWS requests parrot makes, after parrot and its version, such as parrot/myjob, so that they can be told apart in CloudTrail"`
+
+	HTTPTimeout time.Duration `long:"http-timeout" description:"longest an HTTP request to AWS may take, including reading its response, before it fails and can be retried, so that a network stall doesn't hang a worker; 0 means no limit" default:"1m"`
+
+	MaxIdleConns int `long:"max-idle-conns" description:"most idle connections to keep open to each AWS host for reuse, which should be at least --concurrency so that every worker can reuse one" default:"64"`
+
+	PartitionBy string `long:"partition-by" description:"write separate outputs and audio directories per key" choice:"language"`
+
+	CostCeiling float64 `long:"cost-ceiling" description:"stop dispatching new requests once the billed cost in dollars reaches this amount; 0 means no ceiling"`
+
+	PriceStandard float64 `long:"price-standard" description:"dollars per million characters with the standard engine, for cost estimates and --cost-ceiling (default 4)"`
+
+	PriceNeural float64 `long:"price-neural" description:"dollars per million characters with the neural engine (default 16)"`
+
+	PriceLongForm float64 `long:"price-long-form" description:"dollars per million characters with the long-form engine (default 100)"`
+
+	PriceGenerative float64 `long:"price-generative" description:"dollars per million characters with the generative engine (default 30)"`
+
+	MaxTotalChars int `long:"max-total-chars" description:"stop dispatching new requests once the billable characters sent would go over this many"`
+
+	MaxRuntime time.Duration `long:"max-runtime" description:"stop dispatching new requests once the run has taken this long, such as 2h, letting those in flight finish and writing the output for the rows done (default no limit)"`
+
+	RetryBudget float64 `long:"retry-budget" description:"retries allowed across the run, as a percentage of requests made" default:"10"`
+
+	CompareVoices []string `long:"compare-voices" description:"comma-separated voices to synthesize every row with, one output column per voice"`
+
+	Voices []string `long:"voices" description:"comma-separated voices to synthesize every row with, as --compare-voices does but writing one output row per row and voice, with a voice column before the audio column"`
+
+	Format string `short:"f" long:"format" description:"audio output format" choice:"mp3" choice:"ogg_vorbis" choice:"pcm" default:"mp3"`
+
+	WAV bool `long:"wav" description:"wrap --format pcm audio in a WAV header, writing .wav files for tools that can't read raw PCM"`
+
+	SampleRate string `long:"sample-rate" description:"audio sample rate in Hz; pcm only supports 8000 and 16000 (default depends on --engine)" choice:"8000" choice:"16000" choice:"22050" choice:"24000"`
+
+	SSML bool `long:"ssml" description:"treat input text as SSML"`
+
+	FallbackColumn string `long:"fallback-column" description:"zero-based index, or name with --header, of a column holding text to synthesize instead when a row's text is empty or fails in a way retrying wouldn't fix, such as invalid SSML, adding a text_used column after each audio column saying which was synthesized; the fallback is SSML if it starts with <speak>"`
+
+	SSMLColumn string `long:"ssml-column" description:"zero-based index, or name with --header, of a column saying whether each row's text is SSML, as true or false; rows where it's empty are treated as --ssml and --detect-ssml say"`
+
+	DetectSSML bool `long:"detect-ssml" description:"treat each row's text as SSML if it starts with <speak, and as plain text otherwise"`
+
+	ProsodyRate string `long:"prosody-rate" description:"speaking rate to apply to every row with an SSML prosody element, such as slow or 80%"`
+
+	Pitch string `long:"pitch" description:"pitch to apply to every row with an SSML prosody element, such as low or +10%"`
+
+	Volume string `long:"volume" description:"volume to apply to every row with an SSML prosody element, such as loud or -6dB"`
+
+	SpeakingStyle string `long:"speaking-style" description:"speak every row in this style with an SSML amazon:domain element, which needs the neural engine and a voice that has the style" choice:"news" choice:"conversational"`
+
+	TextTemplate string `long:"text-template" description:"Go text/template to render each row into the text to synthesize, in place of --column, with the row's columns by name with --header, such as {{.first_name}}, and as $1, $2 and so on, which are empty past the end of a short row"`
+
+	TextPrefix string `long:"text-prefix" description:"text added before each row's text, inside its speak element with --ssml; it's part of what's hashed for audio filenames and billed"`
+
+	TextSuffix string `long:"text-suffix" description:"text added after each row's text, inside its speak element with --ssml; it's part of what's hashed for audio filenames and billed"`
+
+	Normalize bool `long:"normalize" description:"trim text, collapse its whitespace and convert it to Unicode NFC before deduplicating and synthesizing it; this changes the audio filenames"`
+
+	NormalizeLowercase bool `long:"normalize-lowercase" description:"also lowercase text with --normalize"`
+
+	TrimKey bool `long:"trim-key" description:"trim only the spaces and byte order marks from the ends of each row's text before deduplicating and synthesizing it, leaving the output's copy of it as it was; this changes the audio filenames"`
+
+	Substitutions string `long:"substitutions" description:"CSV file of pattern,replacement lines, or a .json file of an array of objects with pattern and replacement fields, applied in order to each row's text before deduplicating and synthesizing it; a pattern matches whole words, or is a regular expression between slashes such as /colou?r/; what's substituted is hashed for audio filenames and billed, and each row it changes is logged"`
+
+	Lexicons []string `long:"lexicon" description:"name of a Polly pronunciation lexicon to apply; may be given up to five times"`
+
+	PollyParams []string `long:"polly-param" description:"field of Polly's requests to set, as key=value with the SDK's name for it such as LanguageCode=en-GB or LexiconNames=a,b; takes precedence over the flag for the same field, and may be given for several fields"`
+
+	InputFormat string `long:"input-format" description:"format of the input: csv, or jsonl for one JSON object per line with its columns selected by --text-field, --voice-field and --language-field" choice:"csv" choice:"jsonl" default:"csv"`
+
+	TextField string `long:"text-field" description:"field of each --input-format jsonl object holding the text to synthesize" default:"text"`
+
+	VoiceField string `long:"voice-field" description:"field of each --input-format jsonl object holding its voice, overriding --voice when non-empty"`
+
+	LanguageField string `long:"language-field" description:"field of each --input-format jsonl object holding its language code, overriding --language when non-empty"`
+
+	Header bool `long:"header" description:"treat the first row of the input as column names, and write a header to the output"`
+
+	ShardDepth int `long:"shard-depth" description:"nest audio files this many directories deep by the first characters of their hashed name, such as ab/cd/abcd....mp3 for 2"`
+
+	Naming string `long:"naming" description:"how audio files are named: sha1, md5 or sha256 of the text, sequential by row, or column:N after a column's value" default:"sha1"`
+
+	FilenamePrefix string `long:"filename-prefix" description:"text put before the name of every audio file, such as promo_ to namespace the files of one pipeline among others"`
+
+	FilenameSuffix string `long:"filename-suffix" description:"text put after the name of every audio file, before its extension, such as _v2"`
+
+	HashParams bool `long:"hash-params" description:"with a hash --naming scheme, hash the voice, engine, language, format and sample rate along with the text, so that changing any of them synthesizes new audio rather than reusing the old; as this renames the audio, it isn't the default"`
+
+	FilenameColumn string `long:"filename-column" description:"zero-based index, or name with --header, of a column holding each row's audio filename without its extension, used as it is in place of --naming; no two texts may share one"`
+
+	AudioColumnName string `long:"audio-column-name" description:"name of the audio filename column in the output header" default:"audio"`
+
+	AudioColumnPosition int `long:"audio-column-position" description:"zero-based index in the output at which the audio filename column, and any other added columns, are inserted instead of being appended; -1 appends them" default:"-1"`
+
+	Column string `long:"column" description:"zero-based index, or name with --header, of the column holding the text to synthesize" default:"0"`
+
+	TextColumns string `long:"text-columns" description:"comma-separated zero-based indexes, or names with --header, of several columns whose texts are each synthesized into audio of their own, in place of --column; each column's audio columns are added to the output in turn, named after it with --header"`
+
+	VoiceColumn string `long:"voice-column" description:"zero-based index, or name with --header, of a column holding each row's voice, overriding --voice when non-empty"`
+
+	LanguageColumn string `long:"language-column" description:"zero-based index, or name with --header, of a column holding each row's language code, overriding --language when non-empty"`
+
+	ReportUnsupportedCharacters bool `long:"report-unsupported-characters" description:"before synthesizing, list the rows whose text has characters outside the scripts expected for their language, control characters, or the replacement character left where the input couldn't be decoded; the input is read twice, so it can't be stdin"`
+
+	StrictCharacters bool `long:"strict-characters" description:"with --report-unsupported-characters, synthesize nothing if any row has unsupported characters"`
+
+	AllowedScripts []string `long:"allowed-scripts" description:"comma-separated Unicode scripts, such as Latin or Cyrillic, that text is expected to be written in for --report-unsupported-characters, in place of those expected for each row's language"`
+
+	AllowedCharacters string `long:"allowed-characters" description:"comma-separated code points and ranges of them, such as U+2010-U+2027,U+20AC, that are also expected in text for --report-unsupported-characters"`
+
+	AutoLanguage bool `long:"auto-language" description:"when Polly says a voice doesn't support a row's language, synthesize the row in the voice's own language instead of failing it"`
+
+	MaxChars int `long:"max-chars" description:"longest text to send in a single request; longer text is split and the audio concatenated" default:"3000"`
+
+	SplitStrategy string `long:"split-strategy" description:"where text longer than --max-chars is split: between sentences, between paragraphs separated by blank lines, or every --max-chars characters" choice:"sentence" choice:"paragraph" choice:"char" default:"sentence"`
+
+	ChunkGapMs int `long:"chunk-gap-ms" description:"milliseconds of silence, up to 10000, to end each part of a text split by --max-chars with but the last, by sending it as SSML with a break element so that Polly makes the silence in the audio's own format"`
+
+	TextMaxBytes int `long:"text-max-bytes" description:"longest text, in bytes of UTF-8, that a row may have before --text-max-bytes-policy applies to it; 0 allows any length"`
+
+	TextMaxBytesPolicy string `long:"text-max-bytes-policy" description:"what's done with a row whose text is longer than --text-max-bytes: skip it, truncate its text to fit or synthesize it anyway, split as usual; each is logged with its line" choice:"skip" choice:"truncate" choice:"split" default:"skip"`
+
+	ChunkBoundaries bool `long:"chunk-boundaries" description:"write a .chunks.json file next to each new audio file with the text and byte range of each request it was made from, and for mp3 its duration"`
+
+	WriteSourceText bool `long:"write-source-text" description:"write a .txt file next to each new audio file with exactly the text it was synthesized from, after any --text-template, --substitutions, --text-prefix and --text-suffix, or the fallback text if that was used"`
+
+	SpeechMarks []string `long:"speech-marks" description:"comma-separated speech mark types (sentence, ssml, viseme, word) to write alongside each audio file"`
+
+	Subtitles string `long:"subtitles" description:"write captions built from word speech marks alongside each audio file" choice:"srt" choice:"vtt"`
+
+	SubtitleMaxChars int `long:"subtitle-max-chars" description:"longest caption line to write with --subtitles" default:"42"`
+
+	Async bool `long:"async" description:"synthesize with asynchronous Polly tasks that write the audio to S3, for text too long for a single request"`
+
+	S3Bucket string `long:"s3-bucket" description:"S3 bucket that --async tasks write audio to"`
+
+	S3Prefix string `long:"s3-prefix" description:"key prefix for audio written by --async tasks"`
+
+	RampSeconds int `long:"ramp-seconds" description:"start each engine's requests at one a second and raise their rate linearly to its full rate over this many seconds, to avoid throttling when a run starts"`
+
+	AdaptiveRate bool `long:"adaptive-rate" description:"halve an engine's rate whenever Polly throttles its requests, and raise it again by about one request a second each second that it doesn't, up to its full rate"`
+
+	Rate int `long:"rate" description:"most requests to send to Polly per second with --engine, overriding its --rate-* flag (default depends on --engine)"`
+
+	RateStandard int `long:"rate-standard" description:"most requests per second with the standard engine (default 80)"`
+
+	RateNeural int `long:"rate-neural" description:"most requests per second with the neural engine (default 8)"`
+
+	RateLongForm int `long:"rate-long-form" description:"most requests per second with the long-form engine (default 2)"`
+
+	RateGenerative int `long:"rate-generative" description:"most requests per second with the generative engine (default 2)"`
+
+	EmitCharCount bool `long:"emit-char-count" description:"add a billable_chars column before the audio columns with the characters Polly bills for each voice's audio of the row, not counting SSML tags, for attributing costs"`
+
+	RequestIDs bool `long:"request-ids" description:"add a request_ids column after each audio column, and request IDs to --manifest entries, listing the AWS request IDs of the Polly calls each new audio file was made from"`
+
+	WriteMeta bool `long:"write-meta" description:"write a .meta.json file with the size and, for mp3, the duration of each audio file, and add its size to the output"`
+
+	ChecksumVerify bool `long:"checksum-verify" description:"fail rows whose existing audio files no longer match the SHA-256 checksum --write-meta recorded for them; --retry-failed with --force synthesizes them again"`
+
+	VerifyAudio bool `long:"verify-audio" description:"check existing audio files start with a valid header, synthesizing them again if not, rather than only that they aren't empty"`
+
+	ContentTypeExtension bool `long:"content-type-extension" description:"give new audio files the extension of the content type Polly returns for them, rather than --format's, should the two differ"`
+
+	Force bool `long:"force" description:"synthesize every row again, overwriting audio files that already exist"`
+
+	Comment string `long:"comment" description:"character that starts comment lines to skip in CSV input, such as #"`
+
+	LazyQuotes bool `long:"lazy-quotes" description:"allow quotes in unquoted input fields, and unescaped quotes in quoted ones"`
+
+	AlwaysQuote bool `long:"always-quote" description:"quote every field of the output, not just those that need it"`
+
+	CRLF bool `long:"crlf" description:"end the lines of the output and --error-output with \\r\\n instead of \\n; an output being resumed must already end its lines the same way"`
+
+	RaggedColumns bool `long:"ragged-columns" description:"allow rows with a different number of columns than the first, padding them with empty columns or cutting them short to match it"`
+
+	AllowBlankLines bool `long:"allow-blank-lines" description:"skip blank lines, and rows with no text in --column, instead of failing"`
+
+	SkipEmptyText bool `long:"skip-empty-text" description:"skip rows whose text is empty once normalized or rendered with --text-template, rather than failing them"`
+
+	WriteEmptyAudioOnEmptyText bool `long:"write-empty-audio-on-empty-text" description:"give rows whose text, and fallback text, is empty a short silent audio file, synthesized once and shared between them as duplicates are, rather than failing or skipping them; with --fallback-column its text_used column says silence"`
+
+	Limit int `long:"limit" description:"only process the first N rows of the input, not counting the header or rows skipped with --skip"`
+
+	Skip int `long:"skip" description:"skip the first N rows of the input, not counting the header"`
+
+	DryRun bool `long:"dry-run" description:"report what would be synthesized and its estimated cost without calling Polly"`
+
+	CountOnly bool `long:"count-only" description:"report how many rows and distinct texts the input has and how many of those texts already have audio, without calling Polly or writing the output"`
+
+	Preview bool `long:"preview" description:"synthesize only the first row with text, even if its audio exists, report where its audio went and the voice, engine and format it was made with, and stop without reading the rest of the input or writing the output"`
+
+	InputEncoding string `long:"input-encoding" description:"character encoding of a CSV input, such as windows-1252 or ISO-8859-1, converted to UTF-8 as it's read" default:"utf-8"`
+
+	GzipInput bool `long:"gzip-input" description:"read the input as gzipped, which is done anyway if --input ends in .gz"`
+
+	Gzip bool `long:"gzip" description:"gzip the output, which is done anyway if --output ends in .gz"`
+
+	FlushInterval string `long:"flush-interval" description:"flush the output every this many rows, such as 100, or this often, such as 30s, so that it's current if the run dies and --resume can pick up from it"`
+
+	ErrorOutput string `long:"error-output" description:"path to write failed rows to, as line number, text and error"`
+
+	DedupeReport string `long:"dedupe-report" description:"path to write each row skipped or given an earlier row's audio as a duplicate to, as its line number, the earlier row's line number, their text and the audio files they share"`
+
+	FailFast bool `long:"fail-fast" description:"stop the run at the first row that fails, rather than carrying on with the rest and reporting the failures at the end"`
+
+	MaxDuplicateLog int `long:"max-duplicate-log" description:"log only the first this many rows skipped or reused as duplicates, then how many more there were, for input with too many to read through; --dedupe-report still has every one; 0 means no limit"`
+
+	MaxFailures int `long:"max-failures" description:"stop the run once this many rows have failed, as something is likely wrong with every row, keeping the output and --error-output written for the rows done; 0 means no limit"`
+
+	JSONErrors string `long:"json-errors" description:"path to write each failed row, and any error that stops the run, to as a JSON object per line with input, line, text, stage (input, synthesize or fatal), code and message fields, or - for stderr"`
+
+	Bench bool `long:"bench" description:"report in the summary the requests and bytes of audio per second achieved, and the median and 95th percentile time Polly took to answer a request, and how long requests waited on the rate limit compared to Polly, for tuning --concurrency and --rate"`
+
+	StatsJSON string `long:"stats-json" description:"path to keep a JSON snapshot of the run's progress at, rewritten every --stats-interval and at the end, for monitoring long runs"`
+
+	StatsInterval time.Duration `long:"stats-interval" description:"how often to rewrite --stats-json" default:"10s"`
+
+	MetricsAddr string `long:"metrics-addr" description:"address to serve the run's progress at while it runs, such as :9090, in the Prometheus text format at /metrics and as JSON at any other path"`
+
+	Manifest string `long:"manifest" description:"path to write a JSON manifest of the audio files written, with their text, voice, size and billed characters"`
+
+	ManifestAppend bool `long:"manifest-append" description:"merge the audio files written into the --manifest already there, replacing the entries of files written again, so that it lists every file made across runs"`
+
+	Playlist string `long:"playlist" description:"path to write an M3U playlist of the audio files written, in input order, for listening through a batch"`
+
+	OnDuplicate string `long:"on-duplicate" description:"what to do with a row whose text repeats an earlier row's: fail the run, skip it, or reuse the earlier row's audio" choice:"error" choice:"skip" choice:"reuse" default:"reuse"`
+
+	OverwriteOutput bool `long:"overwrite-output" description:"replace --output if it already exists, rather than refusing to"`
+
+	RetryFailed string `long:"retry-failed" description:"path to an --error-output file from an earlier run with the same input; only its rows are synthesized, with those that succeed appended to --output and the file rewritten, once the run is over, with those that fail again or that it doesn't get to"`
+
+	Resume bool `long:"resume" description:"append to an existing output, skipping rows it already contains"`
+
+	SkipExistingInOutput []string `long:"skip-existing-in-output" description:"path to an output CSV from an earlier run, which may be given more than once; rows whose text is in one are skipped without any work"`
+
+	CopyExisting bool `long:"copy-existing" description:"write the earlier output's row for each row skipped by --skip-existing-in-output to --output, rather than leaving it out"`
+
+	Delimiter string `long:"delimiter" description:"field delimiter for the input and output CSVs, such as ; or | or \\t for a tab" default:","`
+
+	Verbose []bool `long:"verbose" description:"log what's done with each row to stderr; give it twice to also log rows that need no work"`
+
+	Quiet bool `short:"q" long:"quiet" description:"write nothing to stderr but fatal errors"`
+
+	Concurrency int `short:"c" long:"concurrency" description:"number of requests to Polly in flight at once" default:"16"`
+
+	Warmup bool `long:"warmup" description:"synthesize a single character before reading the input, so that credentials without permission to synthesize speech fail the run at once rather than at its first row"`
+
+	Sequential bool `long:"sequential" description:"synthesize one row at a time, finishing each before reading the next, so that a run's order and logs can be reproduced when debugging; overrides --concurrency"`
+
+	Order string `long:"order" description:"order rows are synthesized in: as they're read, shuffled using --seed, or by the length of their text, shortest or longest first; the output keeps the input's order either way, but any order other than original reads the whole input into memory first" choice:"original" choice:"shuffle" choice:"shortest-first" choice:"longest-first" default:"original"`
+
+	MaxRetries int `long:"max-retries" description:"times to retry a throttled or failed request before giving up" default:"3"`
+
+	RetryOnEmptyAudio bool `long:"retry-on-empty-audio" description:"retry requests that succeed without any audio, up to --max-retries, rather than failing their rows; no empty audio file is written either way"`
+
+	RetryBaseDelay time.Duration `long:"retry-base-delay" description:"delay before the first retry, doubled on each retry after that" default:"500ms"`
+
+	RequestTimeout time.Duration `long:"request-timeout" description:"longest to wait for a request to Polly and its audio before retrying it, such as 30s (default no limit)"`
+
+	// Seed is a pointer so that a seed of 0 can be told from no seed.
+	Seed *int64 `long:"seed" description:"seed for the random jitter of the waits between retries and for --order shuffle, so that runs with the same input and seed behave the same (default seeded from the time)"`
+
+	// Log is where progress and the summary of a run are written, if
+	// anywhere.
+	Log io.Writer `no-flag:"true"`
+
+	// Clock, if set, replaces the real time for rate limiting and the waits
+	// between retries and polls.
+	Clock Clock `no-flag:"true"`
+
+	// JitterSource, if set, is where the random jitter of the waits between
+	// retries, and the order of a shuffle, come from in place of one seeded
+	// with Seed.
+	JitterSource rand.Source `no-flag:"true"`
+
+	// AWSConfig, if set, is the AWS configuration that Polly and S3 are
+	// called with, rather than one made from the options for each run.
+	// Polly, if set, is the Polly client used instead of one made from the
+	// configuration, such as a *polly.Client or a wrapper around one that
+	// instruments its calls; any retries its SDK makes are on top of
+	// parrot's own. Either lets a long-lived program share one
+	// authenticated client across many runs, each of which still has its own
+	// rate limits and workers.
+	AWSConfig *aws.Config `no-flag:"true"`
+	Polly     Synthesizer `no-flag:"true"`
+}
+
+// DefaultConfig returns a Config with every field set to its flag's default.
+func DefaultConfig() Config {
+	var options Config
+	if _, err := flags.NewParser(&options, flags.None).ParseArgs(nil); err != nil {
+		panic(err)
+	}
+	return options
+}
+
+// Result summarizes a finished run.
+type Result struct {
+	Synthesized int
+	Cached      int
+	// Skipped is how many rows were already in the output being resumed, or
+	// in an earlier output given by --skip-existing-in-output.
+	Skipped int
+	// Duplicates is how many rows were dropped by --on-duplicate skip.
+	Duplicates int
+	// TooLong is how many rows were dropped by --text-max-bytes-policy skip.
+	TooLong int
+	// Failures holds an error for each row that failed, naming its line.
+	Failures []error
+	// Characters is how many characters Polly billed, costing Cost dollars.
+	Characters int64
+	Cost       float64
+	// Interrupted is set if the run's context was cancelled.
+	Interrupted bool
+	// OutputParts holds the files the output was written to with
+	// OutputRotateRows or OutputRotateBytes.
+	OutputParts []string
+	// CostCeilingReached is set if the cost ceiling left RemainingRows rows
+	// undone, CharBudgetReached if --max-total-chars did and DeadlineReached
+	// if --max-runtime did.
+	CostCeilingReached bool
+	CharBudgetReached  bool
+	DeadlineReached    bool
+	RemainingRows      int
+	// With CountOnly, Rows is how many rows had text, UniqueTexts how many
+	// distinct texts they had, ExistingTexts how many of those already had all
+	// their files and NewTexts how many would be synthesized.
+	Rows          int
+	UniqueTexts   int
+	ExistingTexts int
+	NewTexts      int
+}
+
+// extForFormat returns the extension used for audio files in the Polly output
+// format, or "" if it isn't one that's supported. Polly's only OGG format is
+// ogg_vorbis; it has no Opus output.
+func extForFormat(format string) string {
+	switch types.OutputFormat(format) {
+	case types.OutputFormatMp3:
+		return ".mp3"
+	case types.OutputFormatOggVorbis:
+		return ".ogg"
+	case types.OutputFormatPcm:
+		return ".pcm"
+	}
+	return ""
+}
+
+// extForContentType returns the extension used for audio files with the
+// content type Polly returned, or "" if it isn't one of a supported format.
+func extForContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	for format, formatType := range formatContentTypes {
+		if formatType == mediaType {
+			return extForFormat(format)
+		}
+	}
+	return ""
+}
+
+// foundAudioExt returns the extension of the audio file named base in dir if
+// there's none with ext but there is one with another format's extension, as
+// --content-type-extension can leave, or else ext.
+func foundAudioExt(dir string, base string, ext string) (string, error) {
+	if missing, err := audioMissing(filepath.Join(dir, base+ext), "", false); err != nil || !missing {
+		return ext, err
+	}
+	for _, format := range []types.OutputFormat{
+		types.OutputFormatMp3,
+		types.OutputFormatOggVorbis,
+		types.OutputFormatPcm,
+	} {
+		other := extForFormat(string(format))
+		if missing, err := audioMissing(filepath.Join(dir, base+other), "", false); err != nil {
+			return "", err
+		} else if !missing {
+			return other, nil
+		}
+	}
+	return ext, nil
+}
+
+// formatSampleRates maps each supported Polly output format to the sample
+// rates that can be requested for it.
+var formatSampleRates = map[string][]string{
+	string(types.OutputFormatMp3):       {"8000", "16000", "22050", "24000"},
+	string(types.OutputFormatOggVorbis): {"8000", "16000", "22050", "24000"},
+	string(types.OutputFormatPcm):       {"8000", "16000"},
+}
+
+// Engines that the SDK doesn't have constants for yet.
+const (
+	engineLongForm   = "long-form"
+	engineGenerative = "generative"
+)
+
+// newRateLimiters returns a rate limiter for each engine, each allowing its
+// --rate-* flag's requests per second or else the engine's default, except
+// that --rate overrides the limit of the engine the run uses.
+func newRateLimiters(options *Config, engine string, clock Clock) map[string]ratelimit.Limiter {
+	rates := map[string]int{
+		string(types.EngineStandard): options.RateStandard,
+		string(types.EngineNeural):   options.RateNeural,
+		engineLongForm:               options.RateLongForm,
+		engineGenerative:             options.RateGenerative,
+	}
+	if options.Rate > 0 {
+		rates[engine] = options.Rate
+	}
+	limiters := make(map[string]ratelimit.Limiter, len(engines))
+	for name, settings := range engines {
+		rate := settings.maxRequestsPerSecond
+		if rates[name] > 0 {
+			rate = rates[name]
+		}
+		limiters[name] = ratelimit.New(rate, ratelimit.WithClock(clock))
+		if options.RampSeconds > 0 {
+			limiters[name] = &rampLimiter{
+				limiter: limiters[name],
+				clock:   clock,
+				start:   clock.Now(),
+				ramp:    time.Duration(options.RampSeconds) * time.Second,
+				rate:    rate,
+			}
+		}
+		if options.AdaptiveRate {
+			limiters[name] = &adaptiveLimiter{
+				limiter: limiters[name],
+				clock:   clock,
+				max:     float64(rate),
+				rate:    float64(rate),
+			}
+		}
+	}
+	return limiters
+}
+
+// adaptiveLimiter holds the requests its limiter allows to a rate that's
+// halved when Polly throttles them and raised again while it doesn't, by the
+// inverse of the rate for each request that isn't throttled, which comes to
+// about one request a second each second.
+type adaptiveLimiter struct {
+	limiter ratelimit.Limiter
+	clock   Clock
+	max     float64
+
+	mu   sync.Mutex
+	rate float64
+	last time.Time
+	// cut is when the rate was last halved. Requests sent together are
+	// often throttled together, so it's only halved once a second.
+	cut time.Time
+}
+
+func (l *adaptiveLimiter) Take() time.Time {
+	now := l.limiter.Take()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if next := l.last.Add(time.Duration(float64(time.Second) / l.rate)); now.Before(next) {
+		l.clock.Sleep(next.Sub(now))
+		now = next
+	}
+	l.last = now
+	return now
+}
+
+// throttled halves the rate, unless it was halved less than a second ago,
+// returning the rate and whether it changed.
+func (l *adaptiveLimiter) throttled() (float64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	if now.Sub(l.cut) < time.Second || l.rate <= 1 {
+		return l.rate, false
+	}
+	l.rate = math.Max(l.rate/2, 1)
+	l.cut = now
+	return l.rate, true
+}
+
+func (l *adaptiveLimiter) succeeded() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = math.Min(l.rate+1/l.rate, l.max)
+}
+
+// rampLimiter raises the rate its limiter allows linearly from one request a
+// second at start to the full rate once ramp has passed, so that a run's
+// first requests don't all arrive at once.
+type rampLimiter struct {
+	limiter ratelimit.Limiter
+	clock   Clock
+	start   time.Time
+	ramp    time.Duration
+	rate    int
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+func (l *rampLimiter) Take() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	elapsed := now.Sub(l.start)
+	if elapsed >= l.ramp {
+		return l.limiter.Take()
+	}
+	rate := float64(l.rate) * float64(elapsed) / float64(l.ramp)
+	if rate < 1 {
+		rate = 1
+	}
+	if next := l.last.Add(time.Duration(float64(time.Second) / rate)); now.Before(next) {
+		l.clock.Sleep(next.Sub(now))
+		now = next
+	}
+	l.last = now
+	return now
+}
+
+// engineSettings holds the defaults that differ between Polly engines.
+type engineSettings struct {
+	maxRequestsPerSecond int
+	// pricePerMillion is in dollars per million billed characters.
+	pricePerMillion float64
+}
+
+var engines = map[string]engineSettings{
+	string(types.EngineStandard): {maxRequestsPerSecond: 80, pricePerMillion: 4},
+	string(types.EngineNeural):   {maxRequestsPerSecond: 8, pricePerMillion: 16},
+	engineLongForm:               {maxRequestsPerSecond: 2, pricePerMillion: 100},
+	engineGenerative:             {maxRequestsPerSecond: 2, pricePerMillion: 30},
+}
+
+const (
+	// maxRetryTokens is both the retry budget available before any requests
+	// have been made and the most the budget can accumulate.
+	maxRetryTokens = 10
+
+	// synthesisTaskPollInterval is how often an asynchronous synthesis task
+	// is checked for completion.
+	synthesisTaskPollInterval = 5 * time.Second
+
+	// maxLexicons is the most lexicons Polly applies to a single request.
+	maxLexicons = 5
+)
+
+// fileMissing reports whether nothing exists at path.
+func fileMissing(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if err == nil {
+		return false, nil
+	} else if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	}
+	return false, err
+}
+
+// audioMissing reports whether there's no usable audio at path: either
+// nothing is there, or an empty file is, as a crash can leave behind. With
+// verify set the file must also start the way audio in format, which may be
+// formatWAV, does.
+func audioMissing(path string, format string, verify bool) (bool, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	if info.Size() == 0 {
+		return true, nil
+	}
+	if !verify || format == string(types.OutputFormatPcm) {
+		// Raw PCM has no header to check.
+		return false, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(f, header); err == io.ErrUnexpectedEOF {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	switch format {
+	case string(types.OutputFormatMp3):
+		// Either an ID3 tag or an MPEG frame sync.
+		return !bytes.HasPrefix(header, []byte("ID3")) &&
+			!(header[0] == 0xff && header[1]&0xe0 == 0xe0), nil
+	case string(types.OutputFormatOggVorbis):
+		return !bytes.HasPrefix(header, []byte("OggS")), nil
+	case formatWAV:
+		return !bytes.HasPrefix(header, []byte("RIFF")), nil
+	}
+	return false, nil
+}
+
+// partition holds the output CSV and audio directory for one partition key
+// (e.g. a language code) along with its per-partition counts.
+type partition struct {
+	file      *os.File
+	records   chan CSVRecord
+	writeDone chan error
+	audioDir  string
+	// parts holds the files written with --output-rotate-rows or
+	// --output-rotate-bytes, once writing is done.
+	parts       []string
+	rows        int
+	synthesized int
+	cached      int
+
+	// With --resume, the keys already in the output and how many columns
+	// its rows have, or -1 if it was empty.
+	resumed        map[string]bool
+	resumedColumns int
+}
+
+// partitionedOutputPath inserts key before the extension of path, so that
+// "out.csv" becomes "out.en-US.csv" and "out.csv.gz" becomes "out.en-US.csv.gz".
+func partitionedOutputPath(path string, key string) string {
+	if strings.HasSuffix(path, ".gz") {
+		return partitionedOutputPath(strings.TrimSuffix(path, ".gz"), key) + ".gz"
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + key + ext
+}
+
+// costTracker accumulates the characters Polly reports as billed, in total
+// and per voice.
+type costTracker struct {
+	mu              sync.Mutex
+	chars           int64
+	voiceChars      map[string]int64
+	pricePerMillion float64
+}
+
+func newCostTracker(pricePerMillion float64) *costTracker {
+	return &costTracker{
+		voiceChars:      make(map[string]int64),
+		pricePerMillion: pricePerMillion,
+	}
+}
+
+func (c *costTracker) add(voice string, chars int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.chars += chars
+	c.voiceChars[voice] += chars
+}
+
+// voiceTotals returns the billed characters and dollars spent on voice.
+func (c *costTracker) voiceTotals(voice string) (int64, float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	chars := c.voiceChars[voice]
+	return chars, float64(chars) * c.pricePerMillion / 1e6
+}
+
+// cost returns the dollars spent so far.
+func (c *costTracker) cost() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return float64(c.chars) * c.pricePerMillion / 1e6
+}
+
+// estimate returns the dollars text is expected to cost to synthesize.
+func (c *costTracker) estimate(text string, ssml bool) float64 {
+	return float64(billableChars(text, ssml)) * c.pricePerMillion / 1e6
+}
+
+// ssmlEntities decodes the XML entities that can appear in SSML text.
+var ssmlEntities = strings.NewReplacer(
+	"&amp;", "&",
+	"&lt;", "<",
+	"&gt;", ">",
+	"&quot;", `"`,
+	"&apos;", "'")
+
+// billableChars returns how many characters Polly bills for text, which for
+// SSML doesn't include its tags.
+func billableChars(text string, ssml bool) int {
+	if !ssml {
+		return utf8.RuneCountInString(text)
+	}
+	var b strings.Builder
+	inTag := false
+	for _, r := range text {
+		switch {
+		case r == '<':
+			inTag = true
+		case r == '>' && inTag:
+			inTag = false
+		case !inTag:
+			b.WriteRune(r)
+		}
+	}
+	return utf8.RuneCountInString(ssmlEntities.Replace(b.String()))
+}
+
+// characters returns the billed characters so far.
+func (c *costTracker) characters() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.chars
+}
+
+// rowOutcome is what became of an input row.
+type rowOutcome int
+
+const (
+	rowSynthesized rowOutcome = iota
+	rowCached
+	// rowSkipped is a row already in an output being resumed, or in an
+	// earlier output.
+	rowSkipped
+	// rowDuplicate is a row dropped by --on-duplicate skip.
+	rowDuplicate
+	// rowTooLong is a row dropped by --text-max-bytes-policy skip.
+	rowTooLong
+	rowFailed
+	numRowOutcomes
+)
+
+// runStats counts the rows of a run by outcome, along with how many have been
+// read and how many are with the workers.
+type runStats struct {
+	mu       sync.Mutex
+	counts   [numRowOutcomes]int
+	read     int
+	inFlight int
+}
+
+func (s *runStats) add(outcome rowOutcome) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts[outcome]++
+}
+
+func (s *runStats) addRead() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.read++
+}
+
+// addInFlight changes the number of rows with the workers by n.
+func (s *runStats) addInFlight(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inFlight += n
+}
+
+func (s *runStats) count(outcome rowOutcome) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counts[outcome]
+}
+
+// retryBudget is a token bucket shared by every row. Each request deposits
+// ratio tokens and each retry withdraws one, so that when many rows are
+// failing at once retries are limited globally instead of per row.
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+	ratio  float64
+}
+
+func newRetryBudget(percent float64) *retryBudget {
+	return &retryBudget{tokens: maxRetryTokens, ratio: percent / 100}
+}
+
+// deposit records that a request was made.
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += b.ratio
+	if b.tokens > maxRetryTokens {
+		b.tokens = maxRetryTokens
+	}
+}
+
+// withdraw reports whether a retry is allowed, consuming a token if it is.
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// errRequestTimeout is returned for a request that took longer than
+// --request-timeout.
+var errRequestTimeout = errors.New("request timed out")
+
+// errEmptyAudio is returned for a request that succeeded but whose audio was
+// empty, so that no empty audio file is written.
+var errEmptyAudio = errors.New("Polly returned no audio")
+
+// streamError is returned when the audio of a request that succeeded breaks
+// off before it ends, such as when the connection is reset.
+type streamError struct {
+	err error
+}
+
+func (e *streamError) Error() string {
+	return fmt.Sprintf("reading the audio: %v", e.err)
+}
+
+func (e *streamError) Unwrap() error {
+	return e.err
+}
+
+// streamReader reads an audio stream, returning its errors as streamErrors.
+type streamReader struct {
+	r io.Reader
+}
+
+func (s streamReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = &streamError{err: err}
+	}
+	return n, err
+}
+
+// isRetryable reports whether a Polly error is worth retrying, which is the
+// case for throttling, timeouts, audio that breaks off and transient
+// server-side failures. Anything else, such as an invalid voice, won't succeed
+// on a second attempt.
+func isRetryable(err error) bool {
+	if errors.Is(err, errRequestTimeout) {
+		return true
+	}
+	// Polly's audio can't be resumed from where it broke off, so the whole
+	// request is made again.
+	var streamErr *streamError
+	if errors.As(err, &streamErr) {
+		return true
+	}
+	if retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary {
+		return true
+	}
+	var serviceFailure *types.ServiceFailureException
+	if errors.As(err, &serviceFailure) {
+		return true
+	}
+	var respErr *smithyhttp.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.HTTPStatusCode() >= 500
+	}
+	return false
+}
+
+// retryBackoff returns how long to wait before the given retry (starting at
+// 1): base doubled for each earlier retry, with up to half of it jittered
+// away, using jitter, so that rows throttled together don't all retry
+// together.
+func retryBackoff(base time.Duration, retry int, jitter func(n int64) int64) time.Duration {
+	delay := base << uint(retry-1)
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + time.Duration(jitter(int64(half)+1))
+}
+
+// ssmlSnippetChars is how much of the SSML Polly rejects is shown in the
+// row's error.
+const ssmlSnippetChars = 200
+
+// abbreviate returns s cut short to max characters, ending in an ellipsis, if
+// it's longer.
+func abbreviate(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	return string([]rune(s)[:max-1]) + "…"
+}
+
+// ssmlError is Polly rejecting the SSML text of a request.
+type ssmlError struct {
+	text string
+	err  *types.InvalidSsmlException
+}
+
+func (e *ssmlError) Error() string {
+	return fmt.Sprintf("invalid SSML %q: %s", abbreviate(e.text, ssmlSnippetChars), e.err.ErrorMessage())
+}
+
+func (e *ssmlError) Unwrap() error {
+	return e.err
+}
+
+// rowError is the failure of a single input row. stage says where it failed,
+// for --json-errors, and is left empty for rows that failed before they were
+// handed to the workers.
+type rowError struct {
+	input  string
+	lineNo int
+	text   string
+	stage  string
+	err    error
+	// dropped is set for a row whose fetch was dropped once the run was
+	// stopped, which isn't reported as a failure.
+	dropped bool
+}
+
+func (e rowError) Error() string {
+	if e.input != "" {
+		return fmt.Sprintf("%s, line %d: %v", e.input, e.lineNo, e.err)
+	}
+	return fmt.Sprintf("line %d: %v", e.lineNo, e.err)
+}
+
+// pendingRow is an input row waiting on its fetch jobs. Once the last of them
+// finishes, the row is delivered to output as seq, or reported as failed if
+// any of them failed.
+type pendingRow struct {
+	input  string
+	lineNo int
+	seq    int
+	text   string
+	output chan<- CSVRecord
+	// inputColumns is how many of record's columns came from the input.
+	inputColumns int
+
+	mu         sync.Mutex
+	record     []string
+	remaining  int
+	err        error
+	duplicates []duplicateRow
+}
+
+// duplicateRow is a row with the same text as an earlier one, to be written
+// with the earlier row's files instead of synthesizing its own.
+type duplicateRow struct {
+	input  string
+	lineNo int
+	seq    int
+	text   string
+	record []string
+	output chan<- CSVRecord
+}
+
+// occurrence is what became of the first row with some text, for the rows
+// that duplicate it.
+type occurrence struct {
+	input string
+	// files holds the names of the row's audio files, one per voice.
+	files []string
+	// row is the row if its files had to be fetched. Otherwise extra holds
+	// the columns it added to the output.
+	row   *pendingRow
+	extra []string
+	// withheld is set if the row was left out to stay under the cost
+	// ceiling.
+	withheld bool
+	// err is why the row failed before any of its files were fetched.
+	err error
+}
+
+// addDuplicate has dup written along with row once row is finished, or
+// straight away if it already is.
+func (row *pendingRow) addDuplicate(dup duplicateRow, params *fetchAudioParams) {
+	row.mu.Lock()
+	if row.remaining > 0 {
+		row.duplicates = append(row.duplicates, dup)
+		row.mu.Unlock()
+		return
+	}
+	extra, err := row.record[row.inputColumns:], row.err
+	row.mu.Unlock()
+	finishDuplicate(dup, extra, err, params)
+}
+
+// finishDuplicate writes dup with the extra columns of the row it duplicates,
+// or reports it as failed with err if that row failed.
+func finishDuplicate(
+	dup duplicateRow,
+	extra []string,
+	err error,
+	params *fetchAudioParams,
+) {
+	record := CSVRecord{
+		lineNo: dup.lineNo,
+		record: append(append([]string(nil), dup.record...), extra...),
+	}
+	if err == nil {
+		params.stats.add(rowCached)
+		params.orderer.deliver(dup.seq, record, dup.output)
+		return
+	}
+	params.orderer.deliver(dup.seq, record, nil)
+	params.errChan <- rowError{
+		input:   dup.input,
+		lineNo:  dup.lineNo,
+		text:    dup.text,
+		stage:   stageSynthesize,
+		err:     err,
+		dropped: params.ctx.Err() != nil,
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// fetchJob is a single audio file that still has to be fetched.
+type fetchJob struct {
+	text          string
+	ssml          bool
+	languageCode  string
+	voice         string
+	engine        string
+	audioFilepath string
+	// audioKey is the S3 key to upload the audio to instead of a file.
+	audioKey     string
+	metaFilepath string
+	// chunksFilepath is where the boundaries of the requests the audio was
+	// made from are written.
+	chunksFilepath string
+	// sourceFilepath is where the text the audio was made from is written.
+	sourceFilepath string
+	// sizeColumn is the column of the row's output that the audio's size
+	// is written to along with its meta file, or -1 if there isn't one.
+	sizeColumn int
+	// requestIDs, if set, collects the IDs of the requests made for the
+	// audio, which are written to requestIDColumn of the row's output.
+	requestIDs      *[]string
+	requestIDColumn int
+	// contentType, if set, is given the content type of the audio Polly
+	// returns, with which the file may be renamed, along with audioColumn
+	// of the row's output.
+	contentType *string
+	audioColumn int
+	// usedEngine, if set, is the engine the audio is made with, which starts
+	// as engine and is written to engineColumn of the row's output.
+	usedEngine   *string
+	engineColumn int
+	// fallbackText, if set, is synthesized in place of text if text fails in
+	// a way retrying wouldn't fix. Which of the two was is written to
+	// textUsedColumn of the row's output.
+	fallbackText      string
+	fallbackSSML      bool
+	textUsedColumn    int
+	marksFilepath     string
+	subtitlesFilepath string
+	row               *pendingRow
+	manifest          *manifestEntry
+}
+
+// Synthesizer is the part of the Polly client that parrot uses, so that it can
+// be replaced by a fake or wrapped. *polly.Client satisfies it.
+type Synthesizer interface {
+	SynthesizeSpeech(context.Context, *polly.SynthesizeSpeechInput, ...func(*polly.Options)) (*polly.SynthesizeSpeechOutput, error)
+	StartSpeechSynthesisTask(context.Context, *polly.StartSpeechSynthesisTaskInput, ...func(*polly.Options)) (*polly.StartSpeechSynthesisTaskOutput, error)
+	GetSpeechSynthesisTask(context.Context, *polly.GetSpeechSynthesisTaskInput, ...func(*polly.Options)) (*polly.GetSpeechSynthesisTaskOutput, error)
+	DescribeVoices(context.Context, *polly.DescribeVoicesInput, ...func(*polly.Options)) (*polly.DescribeVoicesOutput, error)
+	GetLexicon(context.Context, *polly.GetLexiconInput, ...func(*polly.Options)) (*polly.GetLexiconOutput, error)
+}
+
+var _ Synthesizer = (*polly.Client)(nil)
+
+type fetchAudioParams struct {
+	ctx         context.Context
+	pollyClient Synthesizer
+	// rateLimiters holds a limiter for each engine, as each engine has its
+	// own limit.
+	rateLimiters     map[string]ratelimit.Limiter
+	clock            Clock
+	jitter           func(n int64) int64
+	waitGroup        *sync.WaitGroup
+	costs            *costTracker
+	stats            *runStats
+	timings          *requestTimings
+	retries          *retryBudget
+	maxRetries       int
+	requestTimeout   time.Duration
+	retryDelay       time.Duration
+	maxChars         int
+	splitStrategy    string
+	chunkGapMs       int
+	errChan          chan rowError
+	log              *logger
+	orderer          *rowOrderer
+	jobs             chan fetchJob
+	prosody          string
+	speakingStyle    string
+	format           string
+	sampleRate       string
+	wav              bool
+	lexicons         []string
+	pollyParams      []pollyParam
+	async            bool
+	s3Bucket         string
+	s3Prefix         string
+	audioStore       *audioStore
+	speechMarks      []string
+	subtitles        string
+	subtitleMaxChars int
+	requestIDs       bool
+	voiceCatalog     voiceCatalog
+	autoLanguage     bool
+	engineFallback   bool
+	retryEmptyAudio  bool
+	// contentTypeExt names audio files after the content type Polly returns
+	// for them.
+	contentTypeExt bool
+}
+
+// fetchWorker fetches jobs until params.jobs is closed.
+func fetchWorker(params *fetchAudioParams) {
+	for job := range params.jobs {
+		fetchAudio(job, params)
+	}
+}
+
+// fetchAudio synthesizes job into its audio file, then finishes the job's
+// row. Failures are sent to params.errChan rather than exiting so other
+// in-flight requests can finish. Once params.ctx is canceled, remaining jobs
+// are dropped, and neither their rows nor the failures the cancellation
+// causes are reported, only sent on as dropped.
+func fetchAudio(job fetchJob, params *fetchAudioParams) {
+	defer params.waitGroup.Done()
+	if err := params.ctx.Err(); err != nil {
+		finishJob(job, err, params)
+		return
+	}
+	params.log.rowf(logInfo, job.row.lineNo, job.voice, "synthesizing")
+	err := synthesizeJob(&job, params)
+	if job.textUsedColumn > 0 {
+		used := "text"
+		if err != nil && job.fallbackText != "" && !isRetryable(err) && params.ctx.Err() == nil {
+			params.log.rowf(
+				logInfo,
+				job.row.lineNo,
+				job.voice,
+				"synthesizing the fallback text, as the text failed: %v",
+				err)
+			job.text, job.ssml = job.fallbackText, job.fallbackSSML
+			err = synthesizeJob(&job, params)
+			used = "fallback"
+		}
+		if err == nil {
+			job.row.mu.Lock()
+			if job.row.record[job.textUsedColumn] == "" {
+				job.row.record[job.textUsedColumn] = used
+			}
+			job.row.mu.Unlock()
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("synthesizing with %s: %w", job.voice, err)
+	}
+	finishJob(job, err, params)
+}
+
+// synthesizeJob fetches the files job is missing.
+func synthesizeJob(job *fetchJob, params *fetchAudioParams) error {
+	var err error
+	if params.async {
+		var outputURI string
+		if outputURI, err = runSynthesisTask(*job, params); err == nil {
+			job.row.mu.Lock()
+			job.row.record = append(job.row.record, outputURI)
+			job.row.mu.Unlock()
+		}
+	} else {
+		if params.engineFallback {
+			engine := job.engine
+			job.usedEngine = &engine
+		}
+		if job.audioFilepath != "" || job.audioKey != "" {
+			if params.requestIDs {
+				job.requestIDs = &[]string{}
+			}
+			if params.contentTypeExt {
+				job.contentType = new(string)
+			}
+			err = synthesizeAudio(*job, params)
+			if err == nil && job.contentType != nil {
+				err = renameForContentType(job)
+			}
+			job.contentType = nil
+			if err == nil && job.usedEngine != nil {
+				job.row.mu.Lock()
+				job.row.record[job.engineColumn] = *job.usedEngine
+				job.row.mu.Unlock()
+				if job.manifest != nil {
+					job.manifest.Engine = *job.usedEngine
+				}
+			}
+		}
+		if err == nil && job.requestIDs != nil {
+			job.row.mu.Lock()
+			job.row.record[job.requestIDColumn] = strings.Join(*job.requestIDs, " ")
+			job.row.mu.Unlock()
+			if job.manifest != nil {
+				job.manifest.RequestIDs = *job.requestIDs
+			}
+			job.requestIDs = nil
+		}
+		if err == nil && job.metaFilepath != "" {
+			var size int64
+			size, err = writeAudioMeta(job.audioFilepath, job.metaFilepath, params.format)
+			if job.sizeColumn >= 0 {
+				job.row.mu.Lock()
+				job.row.record[job.sizeColumn] = strconv.FormatInt(size, 10)
+				job.row.mu.Unlock()
+			}
+		}
+		if err == nil && (job.marksFilepath != "" || job.subtitlesFilepath != "") {
+			err = synthesizeMarks(*job, params)
+		}
+	}
+	return err
+}
+
+// renameForContentType gives job's audio file the extension of the content
+// type Polly returned for it, if that's a different one, updating the row's
+// output and manifest to match.
+func renameForContentType(job *fetchJob) error {
+	ext := extForContentType(*job.contentType)
+	current := filepath.Ext(job.audioFilepath)
+	if ext == "" || ext == current {
+		return nil
+	}
+	renamed := strings.TrimSuffix(job.audioFilepath, current) + ext
+	if err := os.Rename(job.audioFilepath, renamed); err != nil {
+		return err
+	}
+	job.audioFilepath = renamed
+	job.row.mu.Lock()
+	name := job.row.record[job.audioColumn]
+	job.row.record[job.audioColumn] = strings.TrimSuffix(name, current) + ext
+	job.row.mu.Unlock()
+	if job.manifest != nil {
+		job.manifest.File = strings.TrimSuffix(job.manifest.File, current) + ext
+		job.manifest.path = renamed
+	}
+	return nil
+}
+
+// finishJob records that job is done, sending its row on once all of the
+// row's jobs are.
+func finishJob(job fetchJob, err error, params *fetchAudioParams) {
+	row := job.row
+	row.mu.Lock()
+	if err != nil && row.err == nil {
+		row.err = err
+	}
+	row.remaining--
+	done := row.remaining == 0
+	duplicates := row.duplicates
+	row.mu.Unlock()
+
+	if !done {
+		return
+	}
+	params.stats.addInFlight(-1)
+	record := CSVRecord{lineNo: row.lineNo, record: row.record}
+	if row.err == nil {
+		params.stats.add(rowSynthesized)
+		params.orderer.deliver(row.seq, record, row.output)
+	} else {
+		params.orderer.deliver(row.seq, record, nil)
+		params.errChan <- rowError{
+			input:   row.input,
+			lineNo:  row.lineNo,
+			text:    row.text,
+			stage:   stageSynthesize,
+			err:     row.err,
+			dropped: params.ctx.Err() != nil,
+		}
+	}
+	for _, dup := range duplicates {
+		finishDuplicate(dup, row.record[row.inputColumns:], row.err, params)
+	}
+}
+
+// synthesizeAudio fetches job's audio, writing it to its audio file or
+// uploading it to its S3 key.
+func synthesizeAudio(job fetchJob, params *fetchAudioParams) error {
+	if job.ssml && !strings.HasPrefix(strings.TrimSpace(job.text), "<speak") {
+		return errors.New("SSML text must start with <speak>")
+	}
+
+	// SSML can't be split without breaking its markup, so it's always sent
+	// whole.
+	chunks := []string{job.text}
+	if !job.ssml {
+		chunks = splitText(job.text, params.maxChars, params.splitStrategy)
+	}
+
+	var boundaries []chunkBoundary
+	write := func(w io.Writer) error {
+		// Each chunk's audio is kept to find its duration.
+		var audio bytes.Buffer
+		offset := int64(0)
+		if params.wav {
+			offset = wavHeaderLen
+		}
+		for i, chunk := range chunks {
+			audio.Reset()
+			request, requestJob := chunk, job
+			if params.chunkGapMs > 0 && i < len(chunks)-1 {
+				request, requestJob.ssml = withBreak(chunk, params.chunkGapMs), true
+			}
+			err := synthesizeChunk(io.MultiWriter(w, &audio), request, requestJob, params, nil)
+			if err != nil {
+				return err
+			}
+			if job.chunksFilepath != "" {
+				boundary := chunkBoundary{
+					Text:      chunk,
+					StartByte: offset,
+					EndByte:   offset + int64(audio.Len()),
+				}
+				if params.format == string(types.OutputFormatMp3) {
+					boundary.DurationSeconds = mp3Duration(audio.Bytes())
+				}
+				boundaries = append(boundaries, boundary)
+			}
+			offset += int64(audio.Len())
+		}
+		return nil
+	}
+	contentType := formatContentTypes[params.format]
+	if params.wav {
+		pcm := write
+		write = func(w io.Writer) error {
+			return writeWAV(w, pcmSampleRate(params.sampleRate), pcm)
+		}
+		contentType = "audio/wav"
+	}
+	if job.audioKey != "" {
+		return params.audioStore.upload(
+			params.ctx,
+			job.audioKey,
+			contentType,
+			write)
+	}
+	if err := writeFile(job.audioFilepath, write); err != nil {
+		return err
+	}
+	if job.chunksFilepath != "" {
+		if err := writeChunkBoundaries(job.chunksFilepath, boundaries); err != nil {
+			return err
+		}
+	}
+	if job.sourceFilepath != "" {
+		return writeFile(job.sourceFilepath, func(w io.Writer) error {
+			_, err := io.WriteString(w, job.text)
+			return err
+		})
+	}
+	return nil
+}
+
+// synthesizeMarks fetches job's speech marks, writing them as
+// newline-delimited JSON to its marks file and as captions to its subtitles
+// file, whichever of the two it has.
+func synthesizeMarks(job fetchJob, params *fetchAudioParams) error {
+	// Mark times are relative to the start of the audio they came from, so
+	// they can't be stitched together across split chunks.
+	if !job.ssml && utf8.RuneCountInString(job.text) > params.maxChars {
+		return fmt.Errorf(
+			"speech marks can't be generated for text longer than %d characters",
+			params.maxChars)
+	}
+
+	// Captions are built from the word and sentence marks, whether or not
+	// they were asked for in the marks file.
+	markTypes := params.speechMarks
+	if params.subtitles != "" {
+		markTypes = []string{string(types.SpeechMarkTypeSentence), string(types.SpeechMarkTypeWord)}
+		for _, markType := range params.speechMarks {
+			if markType != string(types.SpeechMarkTypeSentence) &&
+				markType != string(types.SpeechMarkTypeWord) {
+				markTypes = append(markTypes, markType)
+			}
+		}
+	}
+	var marks bytes.Buffer
+	job.requestIDs = nil
+	if err := synthesizeChunk(&marks, job.text, job, params, markTypes); err != nil {
+		return err
+	}
+
+	if job.marksFilepath != "" {
+		requested, err := filterSpeechMarks(marks.Bytes(), params.speechMarks)
+		if err != nil {
+			return err
+		}
+		err = writeFile(job.marksFilepath, func(w io.Writer) error {
+			_, err := w.Write(requested)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if job.subtitlesFilepath != "" {
+		parsed, err := parseSpeechMarks(marks.Bytes())
+		if err != nil {
+			return err
+		}
+		cues := buildCues(parsed, params.subtitleMaxChars)
+		return writeFile(job.subtitlesFilepath, func(w io.Writer) error {
+			return writeSubtitles(w, cues, params.subtitles)
+		})
+	}
+	return nil
+}
+
+// writeFile fills path using write. The data goes to a temporary file in the
+// same directory which is only renamed to path once it is complete, so that a
+// failure or a killed process never leaves a partial file behind to be
+// mistaken for a finished one on the next run.
+func writeFile(path string, write func(io.Writer) error) error {
+	f, err := createTemp(path)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// createTemp creates the temporary file in path's directory that path is
+// written to before being renamed into place.
+func createTemp(path string) (*os.File, error) {
+	f, err := ioutil.TempFile(
+		filepath.Dir(path),
+		"."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// rowIsSSML reports whether a row's text is SSML: as its ssmlColumn says, if
+// it has one that isn't empty, or else whether it starts with a speak element
+// if detect is set, or else as ssml says.
+func rowIsSSML(text string, record []string, ssmlColumn int, ssml bool, detect bool) (bool, error) {
+	if ssmlColumn >= 0 && strings.TrimSpace(record[ssmlColumn]) != "" {
+		value, err := strconv.ParseBool(strings.TrimSpace(record[ssmlColumn]))
+		if err != nil {
+			return false, fmt.Errorf("--ssml-column value %q isn't true or false", record[ssmlColumn])
+		}
+		return value, nil
+	}
+	if detect {
+		return strings.HasPrefix(strings.TrimSpace(text), "<speak"), nil
+	}
+	return ssml, nil
+}
+
+// checkAudioDir returns an error unless dir is a directory that files can be
+// written to, creating it first if it doesn't exist and create is set, so that
+// a run fails before any work is done rather than at its first row.
+func checkAudioDir(dir string, create bool) error {
+	info, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		if !create {
+			return fmt.Errorf("--audio-out %s doesn't exist; pass --mkdir to create it", dir)
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("--audio-out %s isn't a directory", dir)
+	}
+	f, err := ioutil.TempFile(dir, ".parrot-check.*.tmp")
+	if err != nil {
+		return fmt.Errorf("--audio-out %s isn't writable: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// runSynthesisTask synthesizes job with an asynchronous Polly task that writes
+// the audio to S3, waiting for the task to finish and returning the URI of the
+// audio.
+func runSynthesisTask(job fetchJob, params *fetchAudioParams) (string, error) {
+	text, ssml, err := requestText(job.text, job.ssml, params)
+	if err != nil {
+		return "", err
+	}
+	input := &polly.StartSpeechSynthesisTaskInput{
+		Engine:             types.Engine(job.engine),
+		OutputFormat:       types.OutputFormat(params.format),
+		OutputS3BucketName: aws.String(params.s3Bucket),
+		OutputS3KeyPrefix:  aws.String(params.s3Prefix),
+		Text:               aws.String(text),
+		VoiceId:            types.VoiceId(job.voice),
+		LanguageCode:       types.LanguageCode(job.languageCode)}
+
+	if params.sampleRate != "" {
+		input.SampleRate = aws.String(params.sampleRate)
+	}
+	if len(params.lexicons) > 0 {
+		input.LexiconNames = params.lexicons
+	}
+	if ssml {
+		input.TextType = types.TextTypeSsml
+	}
+	applyPollyParams(input, params.pollyParams)
+
+	takeRate(params, job.engine)
+	started, err := params.pollyClient.StartSpeechSynthesisTask(
+		params.ctx,
+		input)
+	if err != nil {
+		return "", err
+	}
+
+	taskID := started.SynthesisTask.TaskId
+	for {
+		if err := sleepContext(params.ctx, params.clock, synthesisTaskPollInterval); err != nil {
+			return "", err
+		}
+		resp, err := params.pollyClient.GetSpeechSynthesisTask(
+			params.ctx,
+			&polly.GetSpeechSynthesisTaskInput{TaskId: taskID})
+		if err != nil {
+			return "", err
+		}
+		task := resp.SynthesisTask
+		switch task.TaskStatus {
+		case types.TaskStatusCompleted:
+			params.costs.add(job.voice, int64(task.RequestCharacters))
+			return aws.ToString(task.OutputUri), nil
+		case types.TaskStatusFailed:
+			return "", fmt.Errorf(
+				"task %s failed: %s",
+				aws.ToString(taskID),
+				aws.ToString(task.TaskStatusReason))
+		}
+	}
+}
+
+// synthesizeChunk synthesizes text with job's voice and language, appending
+// the audio to w. If speechMarkTypes is non-empty, the speech marks of those
+// types are written instead of audio.
+func synthesizeChunk(
+	w io.Writer,
+	text string,
+	job fetchJob,
+	params *fetchAudioParams,
+	speechMarkTypes []string,
+) error {
+	text, ssml, err := requestText(text, job.ssml, params)
+	if err != nil {
+		return err
+	}
+	engine := job.engine
+	if job.usedEngine != nil {
+		engine = *job.usedEngine
+	}
+	input := &polly.SynthesizeSpeechInput{
+		Engine:       types.Engine(engine),
+		OutputFormat: types.OutputFormat(params.format),
+		Text:         aws.String(text),
+		VoiceId:      types.VoiceId(job.voice),
+		LanguageCode: types.LanguageCode(job.languageCode)}
+
+	if len(speechMarkTypes) > 0 {
+		input.OutputFormat = types.OutputFormatJson
+		for _, markType := range speechMarkTypes {
+			input.SpeechMarkTypes = append(input.SpeechMarkTypes, types.SpeechMarkType(markType))
+		}
+	} else if params.sampleRate != "" {
+		input.SampleRate = aws.String(params.sampleRate)
+	}
+	if len(params.lexicons) > 0 {
+		input.LexiconNames = params.lexicons
+	}
+
+	if ssml {
+		input.TextType = types.TextTypeSsml
+	}
+	applyPollyParams(input, params.pollyParams)
+	if len(speechMarkTypes) > 0 {
+		// Speech marks have no sample rate.
+		input.SampleRate = nil
+	}
+
+	// Each attempt's audio is buffered, so that one which fails partway
+	// through downloading doesn't leave its part in w.
+	var audio bytes.Buffer
+	for retry := 0; ; retry++ {
+		takeRate(params, engine)
+		params.retries.deposit()
+		audio.Reset()
+		err = requestSpeech(&audio, input, job, params)
+		if err == nil ||
+			!(isRetryable(err) || params.retryEmptyAudio && errors.Is(err, errEmptyAudio)) ||
+			retry == params.maxRetries ||
+			!params.retries.withdraw() {
+			break
+		}
+		delay := retryBackoff(params.retryDelay, retry+1, params.jitter)
+		params.log.rowf(
+			logInfo,
+			job.row.lineNo,
+			job.voice,
+			"retry %d in %v: %v",
+			retry+1,
+			delay,
+			err)
+		if err = sleepContext(params.ctx, params.clock, delay); err != nil {
+			break
+		}
+	}
+	var engineErr *types.EngineNotSupportedException
+	if errors.As(err, &engineErr) &&
+		job.usedEngine != nil && engine != string(types.EngineStandard) {
+		params.log.rowf(
+			logInfo,
+			job.row.lineNo,
+			job.voice,
+			"voice doesn't support the %s engine, using %s",
+			engine,
+			types.EngineStandard)
+		// Later requests for the file, such as its other chunks, go straight
+		// to the standard engine.
+		engine = string(types.EngineStandard)
+		*job.usedEngine = engine
+		input.Engine = types.Engine(engine)
+		takeRate(params, engine)
+		audio.Reset()
+		err = requestSpeech(&audio, input, job, params)
+	}
+	var languageErr *types.LanguageNotSupportedException
+	if errors.As(err, &languageErr) {
+		voice := params.voiceCatalog[job.voice]
+		if !params.autoLanguage || voice == nil || voice.LanguageCode == input.LanguageCode {
+			return fmt.Errorf(
+				"voice %s doesn't support language %s",
+				job.voice,
+				input.LanguageCode)
+		}
+		params.log.rowf(
+			logInfo,
+			job.row.lineNo,
+			job.voice,
+			"voice doesn't support language %s, using %s",
+			input.LanguageCode,
+			voice.LanguageCode)
+		input.LanguageCode = voice.LanguageCode
+		takeRate(params, engine)
+		audio.Reset()
+		err = requestSpeech(&audio, input, job, params)
+	}
+	var ssmlErr *types.InvalidSsmlException
+	if errors.As(err, &ssmlErr) {
+		// Only the row fails, and what was sent is shown to help find the
+		// bad markup.
+		return &ssmlError{text: text, err: ssmlErr}
+	}
+	if err != nil {
+		return err
+	}
+	_, err = audio.WriteTo(w)
+	return err
+}
+
+// adaptRate tells the limiter of engine, if it's adaptive, how a request for
+// job went: whether it failed with err and whether any of the SDK's attempts
+// at it, which are recorded in metadata if it succeeded, were throttled.
+func adaptRate(
+	params *fetchAudioParams,
+	engine string,
+	job fetchJob,
+	metadata middleware.Metadata,
+	err error,
+) {
+	limiter, ok := params.rateLimiters[engine].(*adaptiveLimiter)
+	if !ok {
+		return
+	}
+	throttled := err != nil && isThrottle(err)
+	if attempts, ok := retry.GetAttemptResults(metadata); ok && err == nil {
+		for _, attempt := range attempts.Results {
+			throttled = throttled || attempt.Err != nil && isThrottle(attempt.Err)
+		}
+	}
+	if !throttled {
+		if err == nil {
+			limiter.succeeded()
+		}
+		return
+	}
+	if rate, cut := limiter.throttled(); cut {
+		params.log.rowf(
+			logInfo,
+			job.row.lineNo,
+			job.voice,
+			"throttled: %s requests slowed to %.1f a second",
+			engine,
+			rate)
+	}
+}
+
+// throttleCodes holds the codes of the errors AWS throttles requests with.
+var throttleCodes = map[string]bool{
+	"Throttling":               true,
+	"ThrottlingException":      true,
+	"ThrottledException":       true,
+	"TooManyRequestsException": true,
+	"RequestThrottled":         true,
+	"SlowDown":                 true,
+}
+
+// isThrottle reports whether err is Polly throttling a request.
+func isThrottle(err error) bool {
+	if throttleCodes[errorCode(err)] {
+		return true
+	}
+	var respErr *smithyhttp.ResponseError
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusTooManyRequests
+}
+
+// takeRate waits until the rate limit for engine allows another request,
+// recording how long that took with --bench.
+func takeRate(params *fetchAudioParams, engine string) {
+	if params.timings == nil {
+		params.rateLimiters[engine].Take()
+		return
+	}
+	start := params.clock.Now()
+	params.rateLimiters[engine].Take()
+	params.timings.addRateWait(params.clock.Now().Sub(start))
+}
+
+// requestSpeech makes a single request for input's speech, copying it to w.
+// If params has a request timeout, the request and the download together are
+// given that long before failing with errRequestTimeout.
+func requestSpeech(
+	w io.Writer,
+	input *polly.SynthesizeSpeechInput,
+	job fetchJob,
+	params *fetchAudioParams,
+) error {
+	ctx := params.ctx
+	if params.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, params.requestTimeout)
+		defer cancel()
+	}
+	start := params.clock.Now()
+	pollyResponse, err := params.pollyClient.SynthesizeSpeech(ctx, input)
+	latency := params.clock.Now().Sub(start)
+	var metadata middleware.Metadata
+	if err == nil {
+		metadata = pollyResponse.ResultMetadata
+	}
+	adaptRate(params, string(input.Engine), job, metadata, err)
+	var n int64
+	if err == nil {
+		defer pollyResponse.AudioStream.Close()
+		if job.requestIDs != nil {
+			*job.requestIDs = append(*job.requestIDs, requestID(pollyResponse.ResultMetadata))
+		}
+		if job.contentType != nil && *job.contentType == "" {
+			*job.contentType = aws.ToString(pollyResponse.ContentType)
+		}
+		characters := int64(pollyResponse.RequestCharacters)
+		params.costs.add(job.voice, characters)
+		if job.manifest != nil {
+			job.manifest.Characters += characters
+		}
+		n, err = io.Copy(w, streamReader{pollyResponse.AudioStream})
+		if err == nil && n == 0 && input.OutputFormat != types.OutputFormatJson {
+			err = errEmptyAudio
+		}
+	}
+	if params.timings != nil {
+		params.timings.add(latency, n)
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded && params.ctx.Err() == nil {
+		return fmt.Errorf("%w after %v", errRequestTimeout, params.requestTimeout)
+	}
+	return err
+}
+
+// requestID returns the ID AWS gave the request whose response had metadata.
+// The SDK's retries keep it only in the metadata of each attempt, so it's
+// taken from the last of those if it isn't in the response's own.
+func requestID(metadata middleware.Metadata) string {
+	if id, ok := awsmiddleware.GetRequestIDMetadata(metadata); ok {
+		return id
+	}
+	if attempts, ok := retry.GetAttemptResults(metadata); ok && len(attempts.Results) > 0 {
+		last := attempts.Results[len(attempts.Results)-1]
+		id, _ := awsmiddleware.GetRequestIDMetadata(last.ResponseMetadata)
+		return id
+	}
+	return ""
+}
+
+// NewAWSConfig returns the AWS configuration that Polly is called with for
+// options.
+func NewAWSConfig(ctx context.Context, options *Config) (aws.Config, error) {
+	if options.ExternalID != "" && options.AssumeRoleARN == "" {
+		return aws.Config{}, errors.New("--external-id needs --assume-role-arn")
+	}
+	if options.HTTPTimeout < 0 {
+		return aws.Config{}, errors.New("--http-timeout can't be negative")
+	}
+	if options.MaxIdleConns < 1 {
+		return aws.Config{}, errors.New("--max-idle-conns must be at least 1")
+	}
+	httpClient := awshttp.NewBuildableClient().
+		WithTimeout(options.HTTPTimeout).
+		WithTransportOptions(func(tr *http.Transport) {
+			tr.MaxIdleConnsPerHost = options.MaxIdleConns
+			if tr.MaxIdleConns < options.MaxIdleConns {
+				tr.MaxIdleConns = options.MaxIdleConns
+			}
+		})
+	loadOptions := []func(*config.LoadOptions) error{
+		config.WithRegion(options.Region),
+		config.WithHTTPClient(httpClient),
+	}
+	if options.Profile != "" {
+		loadOptions = append(loadOptions, config.WithSharedConfigProfile(options.Profile))
+	}
+	if options.Endpoint != "" {
+		// An http:// endpoint, as LocalStack usually has, is used as is.
+		resolver := aws.EndpointResolverFunc(func(service, region string) (aws.Endpoint, error) {
+			return aws.Endpoint{URL: options.Endpoint, SigningRegion: region}, nil
+		})
+		loadOptions = append(loadOptions, config.WithEndpointResolver(resolver))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, loadOptions...)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.Region == "" {
+		return cfg, errors.New(
+			"no AWS region is configured; pass --region, or --profile for a profile that has one, or set AWS_REGION")
+	}
+	// The credentials are cached, so getting them now costs nothing later.
+	if _, err := cfg.Credentials.Retrieve(ctx); err != nil {
+		return cfg, fmt.Errorf(
+			"no AWS credentials were found; pass --profile, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or configure them with aws configure: %w",
+			err)
+	}
+	cfg.APIOptions = append(cfg.APIOptions, awsmiddleware.AddUserAgentKeyValue("parrot", Version))
+	if options.UserAgent != "" {
+		cfg.APIOptions = append(cfg.APIOptions, awsmiddleware.AddUserAgentKey(options.UserAgent))
+	}
+	if options.AssumeRoleARN == "" {
+		return cfg, nil
+	}
+	provider := stscreds.NewAssumeRoleProvider(
+		sts.NewFromConfig(cfg),
+		options.AssumeRoleARN,
+		func(o *stscreds.AssumeRoleOptions) {
+			if options.ExternalID != "" {
+				o.ExternalID = aws.String(options.ExternalID)
+			}
+		})
+	cfg.Credentials = aws.NewCredentialsCache(provider)
+	return cfg, nil
+}
+
+// newPollyClient returns the Polly client used with cfg unless Config.Polly is
+// set. Requests are retried by parrot, within --max-retries and the retry
+// budget and through the rate limiter, so the SDK only makes one attempt at
+// each.
+func newPollyClient(cfg aws.Config) *polly.Client {
+	return polly.NewFromConfig(cfg, func(o *polly.Options) {
+		o.Retryer = retry.AddWithMaxAttempts(retry.NewStandard(), 1)
+	})
+}
+
+// Run synthesizes the input options names, returning a summary of what was
+// done. Cancelling ctx stops new work from starting and cancels requests in
+// flight, after which Run returns with Result.Interrupted set. An error is
+// only returned if the run couldn't carry on; a row that fails is counted in
+// the Result instead.
+func Run(ctx context.Context, options Config) (Result, error) {
+	var jsonErrors *jsonErrorWriter
+	if options.JSONErrors != "" {
+		w := os.Stderr
+		if options.JSONErrors != "-" {
+			f, err := os.Create(options.JSONErrors)
+			if err != nil {
+				return Result{}, err
+			}
+			defer f.Close()
+			w = f
+		}
+		jsonErrors = newJSONErrorWriter(w)
+	}
+	result, err := run(ctx, options, jsonErrors)
+	if jsonErrors != nil {
+		if err != nil {
+			jsonErrors.writeFatal(err)
+		}
+		if writeErr := jsonErrors.Error(); writeErr != nil && err == nil {
+			return Result{}, fmt.Errorf("writing --json-errors: %w", writeErr)
+		}
+	}
+	return result, err
+}
+
+// run is Run, writing errors to jsonErrors if it isn't nil.
+func run(ctx context.Context, options Config, jsonErrors *jsonErrorWriter) (Result, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	st, err := newRunState(&options)
+	if err != nil {
+		return Result{}, err
+	}
+	st.ctx, st.cancel = ctx, cancel
+
+	level := logNormal + logLevel(len(options.Verbose))
+	if level > logDebug {
+		level = logDebug
+	}
+	if options.Quiet {
+		level = logQuiet
+	}
+	logOutput := options.Log
+	if logOutput == nil {
+		logOutput = ioutil.Discard
+	}
+	log := newLogger(logOutput, level)
+	st.log = log
+
+	if err := st.setUpPolly(); err != nil {
+		return Result{}, err
+	}
+
+	st.seen = NewSeenTracker()
+	st.seen.Start()
+	defer st.seen.Stop()
+
+	// Retrying failed rows appends them to the output, and unless it's a dry
+	// run replaces the errors they're read from with those that are left.
+	var retryLines map[rowLocation][]string
+	if options.RetryFailed != "" {
+		if retryLines, err = readFailedLines(options.RetryFailed, st.delimiter); err != nil {
+			return Result{}, err
+		}
+		options.Resume = true
+		if options.ErrorOutput == "" && !options.DryRun {
+			options.ErrorOutput = options.RetryFailed
+		}
+		st.retriedRows = make(map[rowLocation]bool)
+	}
+	st.retryLines = retryLines
+
+	var errorWriter *csv.Writer
+	if options.ErrorOutput != "" {
+		// The errors that replace those being retried are written beside
+		// them, and only renamed over them once the run is over, along with
+		// any of the rows it didn't get to.
+		var errorFile *os.File
+		if options.ErrorOutput == options.RetryFailed {
+			errorFile, err = createTemp(options.RetryFailed)
+			if err == nil {
+				st.retryErrorFile = errorFile
+				defer os.Remove(errorFile.Name())
+			}
+		} else {
+			errorFile, err = os.Create(options.ErrorOutput)
+		}
+		if err != nil {
+			return Result{}, err
+		}
+		defer errorFile.Close()
+		errorWriter = csv.NewWriter(errorFile)
+		errorWriter.Comma = st.delimiter
+		errorWriter.UseCRLF = options.CRLF
+	}
+	var dedupeWriter *csv.Writer
+	if options.DedupeReport != "" {
+		dedupeFile, err := os.Create(options.DedupeReport)
+		if err != nil {
+			return Result{}, err
+		}
+		defer dedupeFile.Close()
+		dedupeWriter = csv.NewWriter(dedupeFile)
+		dedupeWriter.Comma = st.delimiter
+		dedupeWriter.UseCRLF = options.CRLF
+	}
+	st.errorWriter, st.dedupeWriter = errorWriter, dedupeWriter
+
+	records := make(chan CSVRecord)
+	readDone := make(chan error, 1)
+	readLimit := options.Limit
+	if readLimit > 0 {
+		readLimit += options.Skip
+	}
+	// readCtx lets --preview stop the reader without stopping the workers.
+	readCtx, stopReading := context.WithCancel(ctx)
+	defer stopReading()
+	read := func(ctx context.Context, path string, records chan<- CSVRecord) error {
+		if options.InputFormat == "jsonl" {
+			return ReadJSONLFile(ctx, path, JSONLReadOptions{
+				Gzipped:    options.GzipInput,
+				AllowBlank: options.AllowBlankLines,
+			}, records)
+		}
+		return ReadCSVFile(ctx, path, CSVReadOptions{
+			Gzipped:    options.GzipInput,
+			Encoding:   st.inputEncoding,
+			Delimiter:  st.delimiter,
+			Comment:    st.comment,
+			AllowBlank: options.AllowBlankLines,
+			Ragged:     options.RaggedColumns,
+			LazyQuotes: options.LazyQuotes,
+		}, records)
+	}
+	go func() {
+		readDone <- readInputs(readCtx, st.inputs, options.Header, readLimit, read, records)
+	}()
+
+	// With --header the first record names the columns, and is written back
+	// out, with names for the added columns, as the output's header.
+	if options.Header {
+		r, ok := <-records
+		if !ok {
+			if err := <-readDone; err != nil {
+				return Result{}, err
+			}
+			return Result{}, errors.New("--header given but the input is empty")
+		}
+		if err := st.useHeader(r.record); err != nil {
+			return Result{}, err
+		}
+	}
+	if err := st.setUpOutput(); err != nil {
+		return Result{}, err
+	}
+
+	st.setUpFetching()
+	fetchParams := st.fetchParams
+	reporter := &statsReporter{
+		stats: fetchParams.stats,
+		costs: fetchParams.costs,
+		clock: st.clock,
+		start: st.clock.Now(),
+	}
+	st.reporter = reporter
+	if options.MetricsAddr != "" {
+		listener, err := net.Listen("tcp", options.MetricsAddr)
+		if err != nil {
+			return Result{}, fmt.Errorf("--metrics-addr: %w", err)
+		}
+		server := &http.Server{Handler: reporter}
+		go server.Serve(listener)
+		defer server.Close()
+	}
+	statsStop := make(chan struct{})
+	statsDone := make(chan struct{})
+	if options.StatsJSON != "" {
+		go func() {
+			reporter.writeJSONEvery(options.StatsJSON, options.StatsInterval, log, statsStop)
+			close(statsDone)
+		}()
+	} else {
+		close(statsDone)
+	}
+
+	for i := 0; i < options.Concurrency; i++ {
+		go fetchWorker(fetchParams)
+	}
+
+	fetchErrsDone := st.collectFailures(jsonErrors)
+	interrupted, runErr := st.handleRows(records, readDone, stopReading)
+
+	// Even when the run can't carry on, everything started is waited for so
+	// that nothing is left running once Run returns.
+	outputParts, runErr := st.finish(runErr, fetchErrsDone)
+	interrupted = interrupted || ctx.Err() != nil
+	close(statsStop)
+	<-statsDone
+	if options.StatsJSON != "" {
+		if err := reporter.writeJSON(options.StatsJSON); err != nil && runErr == nil {
+			runErr = fmt.Errorf("writing --stats-json: %w", err)
+		}
+	}
+	if runErr != nil {
+		return Result{}, runErr
+	}
+	if options.Manifest != "" {
+		if err := writeManifest(options.Manifest, st.manifest, options.ManifestAppend); err != nil {
+			return Result{}, err
+		}
+	}
+	if options.Playlist != "" {
+		if err := writePlaylist(options.Playlist, st.manifest, options.Format); err != nil {
+			return Result{}, err
+		}
+	}
+
+	return st.summarize(interrupted, outputParts), nil
+}
+
+// runState is what a run works out from its options before reading the input,
+// and what it keeps track of as it goes.
+type runState struct {
+	options  *Config
+	ctx      context.Context
+	cancel   context.CancelFunc
+	log      *logger
+	reporter *statsReporter
+
+	inputs                   []string
+	audioBucket, audioPrefix string
+	// matrix is set for --voices, which is otherwise --compare-voices.
+	matrix          bool
+	voices          []string
+	speechMarkTypes []string
+	engine          string
+	audioExt        string
+	fileFormat      string
+	pollyParams     []pollyParam
+	// Columns given by name are resolved once the header has been read.
+	column, voiceColumn, languageColumn, ssmlColumn, fallbackColumn int
+	textColumns                                                     []int
+
+	delimiter, comment rune
+	inputEncoding      encoding.Encoding
+	flushRows          int
+	flushInterval      time.Duration
+	textTmpl           *textTemplate
+	substitutions      []substitution
+	rotateBytes        uint64
+	rotating           bool
+	minFreeDisk        uint64
+	// extraColumns is how many columns are added to each input row in the
+	// output.
+	extraColumns int
+
+	store           *audioStore
+	voiceCatalog    voiceCatalog
+	pollyClient     Synthesizer
+	pricePerMillion float64
+	seen            *SeenTracker
+	// retryLines holds the error output's line for each row being retried,
+	// and retriedRows those of them the run has got to. If the errors left
+	// replace those being retried, retryErrorFile is where they're written
+	// until then.
+	retryLines     map[rowLocation][]string
+	retriedRows    map[rowLocation]bool
+	retryErrorFile *os.File
+	errorWriter    *csv.Writer
+	dedupeWriter   *csv.Writer
+	header         []string
+	outputHeader   []string
+	namer          *audioNamer
+	// outputColumn is the text's column in an output, which has moved along
+	// if the added columns are inserted before it.
+	outputColumn   int
+	earlierRows    map[string][]string
+	compressOutput bool
+	outputFormat   CSVWriteOptions
+	partitions     map[string]*partition
+	clock          Clock
+	deadline       time.Time
+	// Rows handled out of order are all read before any is written.
+	reordering  bool
+	fetchParams *fetchAudioParams
+
+	// Failed rows, collected until the fetch goroutines have all exited, and
+	// the error that stops the run with --fail-fast or --max-failures.
+	fetchErrs   []rowError
+	failFastErr error
+	// droppedRows are the rows whose fetches were dropped when the run was
+	// stopped, and which were never finished.
+	droppedRows []rowLocation
+
+	// Set once the cost ceiling stops dispatching; the rest of the input is
+	// only counted.
+	ceilingReached bool
+	// The estimated cost of the requests dispatched since spending was last
+	// brought up to date, which may not have been billed yet.
+	unbilledEstimate float64
+	remainingRows    int
+
+	// Set once the next row would take the characters dispatched past
+	// --max-total-chars, after which the rest of the input is only counted.
+	budgetReached   bool
+	dispatchedChars int
+
+	// Set once --max-runtime has passed, after which the rest of the input is
+	// only counted.
+	deadlineReached bool
+
+	// The jobs of the row synthesized for --preview, once there is one, and
+	// its line.
+	previewed   []fetchJob
+	previewLine int
+
+	// Totals reported by a dry run.
+	newFiles    int
+	cachedFiles int
+	newChars    int
+	// For --count-only, the rows with text, and the distinct texts among
+	// them that already have their files and that don't.
+	countedRows   int
+	existingTexts int
+	newTexts      int
+
+	// How many rows have been skipped or reused as duplicates, of which only
+	// the first --max-duplicate-log are logged.
+	duplicatesNoticed int
+
+	manifest []*manifestEntry
+	// occurrences holds the first row read with each distinct text.
+	occurrences map[string]*occurrence
+	dataRows    int
+	// With --text-columns, textColumn is which of them the row being
+	// handled is for, and textRows how many rows they've been handled for.
+	textColumn int
+	textRows   int
+}
+
+// newRunState checks options, returning the state of a run with what follows
+// from them. Some of them are filled in or changed along the way, such as
+// --count-only making the run a dry run.
+func newRunState(options *Config) (*runState, error) {
+	// JSONL is read as if it were CSV with a header naming the fields, but
+	// without a line for it in the input.
+	if options.InputFormat == "jsonl" {
+		options.Header = true
+		options.Column = options.TextField
+		options.VoiceColumn = options.VoiceField
+		options.LanguageColumn = options.LanguageField
+	}
+	inputs, err := expandInputs(options.Input)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.AudioOut == "" && options.AudioS3 == "" {
+		return nil, errors.New("one of --audio-out or --audio-s3 is required")
+	}
+	var audioBucket, audioPrefix string
+	if options.AudioS3 != "" {
+		if options.AudioOut != "" {
+			return nil, errors.New("--audio-s3 can't be combined with --audio-out")
+		}
+		if options.Async || len(options.SpeechMarks) > 0 || options.Subtitles != "" ||
+			options.Manifest != "" || options.Playlist != "" || options.VerifyAudio ||
+			options.WriteMeta || options.ChunkBoundaries || options.WriteSourceText ||
+			options.ChecksumVerify || options.ContentTypeExtension {
+			return nil, errors.New(
+				"--audio-s3 can't be combined with --async, --speech-marks, --subtitles, --manifest, --playlist, --verify-audio, --write-meta, --chunk-boundaries, --write-source-text, --checksum-verify or --content-type-extension")
+		}
+		var err error
+		if audioBucket, audioPrefix, err = parseS3URI(options.AudioS3); err != nil {
+			return nil, err
+		}
+	} else if options.S3ListExisting {
+		return nil, errors.New("--s3-list-existing needs --audio-s3")
+	}
+	if options.AudioOut != "" {
+		if err := checkAudioDir(options.AudioOut, options.Mkdir); err != nil {
+			return nil, err
+		}
+	} else if options.Mkdir {
+		return nil, errors.New("--mkdir needs --audio-out")
+	}
+	if isStdio(options.Output) &&
+		(options.PartitionBy != "" || options.Resume || options.RetryFailed != "") {
+		return nil, errors.New(
+			"--partition-by, --resume and --retry-failed need --output to be a file, not stdout")
+	}
+
+	// --voices is --compare-voices with each voice's columns on an output
+	// row of their own.
+	voicesFlag := "--compare-voices"
+	matrix := len(options.Voices) > 0
+	if matrix {
+		if len(options.CompareVoices) > 0 {
+			return nil, errors.New("--voices can't be combined with --compare-voices")
+		}
+		if options.CopyExisting {
+			return nil, errors.New("--voices can't be combined with --copy-existing")
+		}
+		if options.EmitVoice {
+			return nil, errors.New("--emit-voice can't be combined with --voices, which adds a voice column anyway")
+		}
+		options.CompareVoices = options.Voices
+		voicesFlag = "--voices"
+	}
+	voices := []string{options.Voice}
+	if len(options.CompareVoices) > 0 {
+		voices = nil
+		for _, list := range options.CompareVoices {
+			for _, voice := range strings.Split(list, ",") {
+				if voice = strings.TrimSpace(voice); voice != "" {
+					voices = append(voices, voice)
+				}
+			}
+		}
+	}
+	if (len(voices) == 0 || voices[0] == "") && options.VoiceColumn == "" {
+		return nil, errors.New(
+			"one of --voice, --compare-voices, --voices or --voice-column is required")
+	}
+	if options.Language == "" && options.LanguageColumn == "" {
+		return nil, errors.New(
+			"one of --language or --language-column is required")
+	}
+	if options.VoiceColumn != "" && len(options.CompareVoices) > 0 {
+		return nil, fmt.Errorf(
+			"--voice-column can't be combined with %s", voicesFlag)
+	}
+
+	var speechMarkTypes []string
+	for _, list := range options.SpeechMarks {
+		for _, markType := range strings.Split(list, ",") {
+			markType = strings.TrimSpace(markType)
+			if markType == "" {
+				continue
+			}
+			valid := false
+			for _, known := range types.SpeechMarkType("").Values() {
+				valid = valid || markType == string(known)
+			}
+			if !valid {
+				return nil, fmt.Errorf("unknown speech mark type %q", markType)
+			}
+			speechMarkTypes = append(speechMarkTypes, markType)
+		}
+	}
+	if options.Async && (len(speechMarkTypes) > 0 || options.Subtitles != "" ||
+		options.WriteMeta || options.ChunkBoundaries || options.WriteSourceText ||
+		options.RequestIDs || options.VoiceEngineFallback || options.EmitVoice ||
+		options.EmitEngine || options.FallbackColumn != "" || options.Warmup || options.Bench) {
+		return nil, errors.New(
+			"--async can't be combined with --speech-marks, --subtitles, --write-meta, --chunk-boundaries, --write-source-text, --request-ids, --voice-engine-fallback, --emit-voice, --emit-engine, --fallback-column, --warmup or --bench")
+	}
+	if options.SubtitleMaxChars < 1 {
+		return nil, errors.New("--subtitle-max-chars must be at least 1")
+	}
+
+	if options.CountOnly {
+		if options.Resume || options.RetryFailed != "" || options.PartitionBy != "" ||
+			options.ErrorOutput != "" || options.Manifest != "" || options.Playlist != "" ||
+			options.OutputRotateRows != 0 || options.OutputRotateBytes != "" {
+			return nil, errors.New(
+				"--count-only writes no output, so can't be combined with --resume, --retry-failed, --partition-by, --error-output, --manifest, --playlist, --output-rotate-rows or --output-rotate-bytes")
+		}
+		// A count is a dry run whose rows are thrown away.
+		options.DryRun = true
+		options.Output = os.DevNull
+	}
+	if options.Preview {
+		if options.Async || options.DryRun || options.Resume || options.RetryFailed != "" ||
+			options.PartitionBy != "" || options.ErrorOutput != "" || options.Manifest != "" ||
+			options.Playlist != "" || options.OutputRotateRows != 0 || options.OutputRotateBytes != "" {
+			return nil, errors.New(
+				"--preview writes no output, so can't be combined with --async, --dry-run, --count-only, --resume, --retry-failed, --partition-by, --error-output, --manifest, --playlist, --output-rotate-rows or --output-rotate-bytes")
+		}
+		// The row is always synthesized, so that changes that don't
+		// change its filename are heard, and the output is thrown away.
+		options.Force = true
+		options.Output = os.DevNull
+	}
+	if (options.Manifest != "" || options.Playlist != "") && (options.Async || options.DryRun) {
+		return nil, errors.New(
+			"--manifest and --playlist can't be combined with --async or --dry-run")
+	}
+	if options.ManifestAppend && options.Manifest == "" {
+		return nil, errors.New("--manifest-append needs --manifest")
+	}
+	if options.CopyExisting && len(options.SkipExistingInOutput) == 0 {
+		return nil, errors.New("--copy-existing needs --skip-existing-in-output")
+	}
+	if options.Quiet && len(options.Verbose) > 0 {
+		return nil, errors.New("--quiet can't be combined with --verbose")
+	}
+	if options.NormalizeLowercase && !options.Normalize {
+		return nil, errors.New("--normalize-lowercase needs --normalize")
+	}
+	if len(options.Lexicons) > maxLexicons {
+		return nil, fmt.Errorf(
+			"--lexicon can be given at most %d times",
+			maxLexicons)
+	}
+
+	audioExt := extForFormat(options.Format)
+	if audioExt == "" {
+		return nil, fmt.Errorf(
+			"--format %q isn't supported; Polly's audio formats are mp3, ogg_vorbis and pcm",
+			options.Format)
+	}
+	pollyParams, err := parsePollyParams(options.PollyParams)
+	if err != nil {
+		return nil, err
+	}
+	// A sample rate given as a Polly parameter is checked, and written into
+	// WAV headers, as --sample-rate's is.
+	for i, param := range pollyParams {
+		if param.field == "SampleRate" {
+			options.SampleRate = param.values[0]
+			pollyParams = append(pollyParams[:i], pollyParams[i+1:]...)
+			break
+		}
+	}
+	fileFormat := options.Format
+	if options.WAV {
+		if options.Format != string(types.OutputFormatPcm) {
+			return nil, errors.New("--wav needs --format pcm")
+		}
+		if options.Async || options.ContentTypeExtension {
+			return nil, errors.New(
+				"--wav can't be combined with --async or --content-type-extension")
+		}
+		audioExt, fileFormat = ".wav", formatWAV
+	}
+	if options.SampleRate != "" {
+		valid := false
+		for _, rate := range formatSampleRates[options.Format] {
+			valid = valid || options.SampleRate == rate
+		}
+		if !valid {
+			return nil, fmt.Errorf(
+				"--sample-rate %s isn't supported for --format %s",
+				options.SampleRate,
+				options.Format)
+		}
+	}
+	if options.Sequential {
+		options.Concurrency = 1
+	}
+	if options.Concurrency < 1 {
+		return nil, errors.New("--concurrency must be at least 1")
+	}
+	// Columns given by name are resolved once the header has been read.
+	column, err := resolveColumn(options.Column, nil)
+	if err != nil && !options.Header {
+		return nil, fmt.Errorf("--column: %w", err)
+	}
+	voiceColumn, err := resolveColumn(options.VoiceColumn, nil)
+	if err != nil && !options.Header {
+		return nil, fmt.Errorf("--voice-column: %w", err)
+	}
+	languageColumn, err := resolveColumn(options.LanguageColumn, nil)
+	if err != nil && !options.Header {
+		return nil, fmt.Errorf("--language-column: %w", err)
+	}
+	ssmlColumn, err := resolveColumn(options.SSMLColumn, nil)
+	if err != nil && !options.Header {
+		return nil, fmt.Errorf("--ssml-column: %w", err)
+	}
+	fallbackColumn, err := resolveColumn(options.FallbackColumn, nil)
+	if err != nil && !options.Header {
+		return nil, fmt.Errorf("--fallback-column: %w", err)
+	}
+	textColumns, err := resolveColumns(options.TextColumns, nil)
+	if err != nil && !options.Header {
+		return nil, fmt.Errorf("--text-columns: %w", err)
+	}
+	if options.TextColumns != "" {
+		// Each column's row is handled as a row of its own and put back
+		// together with the others on its way to be written, which these
+		// can't work with.
+		if options.TextTemplate != "" || options.Resume || options.RetryFailed != "" ||
+			len(options.SkipExistingInOutput) > 0 || options.Order != "original" ||
+			matrix || options.FilenameColumn != "" {
+			return nil, errors.New(
+				"--text-columns can't be combined with --text-template, --resume, --retry-failed, --skip-existing-in-output, --order, --voices or --filename-column")
+		}
+	}
+	for _, affix := range []struct{ flag, value string }{
+		{"--filename-prefix", options.FilenamePrefix},
+		{"--filename-suffix", options.FilenameSuffix},
+	} {
+		if strings.ContainsAny(affix.value, `/\`) {
+			return nil, fmt.Errorf("%s %q can't contain / or \\", affix.flag, affix.value)
+		}
+	}
+	if options.TextMaxBytes < 0 {
+		return nil, errors.New("--text-max-bytes can't be negative")
+	}
+	if options.WriteEmptyAudioOnEmptyText && options.SkipEmptyText {
+		return nil, errors.New("--write-empty-audio-on-empty-text can't be combined with --skip-empty-text")
+	}
+	if options.MaxDuplicateLog < 0 {
+		return nil, errors.New("--max-duplicate-log can't be negative")
+	}
+	if options.MaxFailures < 0 {
+		return nil, errors.New("--max-failures can't be negative")
+	}
+	if options.MaxChars < 1 || options.MaxChars > pollyMaxChars {
+		return nil, fmt.Errorf(
+			"--max-chars must be between 1 and %d",
+			pollyMaxChars)
+	}
+	if options.ChunkGapMs < 0 || options.ChunkGapMs > maxBreakMs {
+		return nil, fmt.Errorf("--chunk-gap-ms must be between 0 and %d", maxBreakMs)
+	}
+	if options.ChunkGapMs > 0 && options.Async {
+		return nil, errors.New("--chunk-gap-ms can't be combined with --async, whose text isn't split")
+	}
+	if options.Async && options.S3Bucket == "" {
+		return nil, errors.New("--async requires --s3-bucket")
+	}
+	if options.Async && len(options.CompareVoices) > 0 {
+		return nil, fmt.Errorf("--async can't be combined with %s", voicesFlag)
+	}
+	delimiter, err := parseDelimiter(options.Delimiter)
+	if err != nil {
+		return nil, err
+	}
+	inputEncoding, err := parseInputEncoding(options.InputEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("--input-encoding: %w", err)
+	}
+	if inputEncoding != nil && options.InputFormat == "jsonl" {
+		return nil, errors.New("--input-encoding only applies to CSV input; JSONL is always UTF-8")
+	}
+	var comment rune
+	if options.Comment != "" {
+		if comment, err = parseDelimiter(options.Comment); err != nil {
+			return nil, fmt.Errorf("--comment: %w", err)
+		}
+		if comment == delimiter {
+			return nil, errors.New("--comment can't be the same as --delimiter")
+		}
+	}
+	if options.RequestTimeout < 0 {
+		return nil, errors.New("--request-timeout can't be negative")
+	}
+	if options.MaxRetries < 0 {
+		return nil, errors.New("--max-retries can't be negative")
+	}
+	if options.RetryBudget < 0 {
+		return nil, errors.New("--retry-budget can't be negative")
+	}
+	if options.Limit < 0 || options.Skip < 0 {
+		return nil, errors.New("--limit and --skip can't be negative")
+	}
+	if options.Rate < 0 || options.RateStandard < 0 || options.RateNeural < 0 ||
+		options.RateLongForm < 0 || options.RateGenerative < 0 {
+		return nil, errors.New("rates can't be negative")
+	}
+	if options.RampSeconds < 0 {
+		return nil, errors.New("--ramp-seconds can't be negative")
+	}
+	if options.CostCeiling < 0 {
+		return nil, errors.New("--cost-ceiling can't be negative")
+	}
+	if options.MaxTotalChars < 0 {
+		return nil, errors.New("--max-total-chars can't be negative")
+	}
+	if options.AudioColumnPosition < -1 {
+		return nil, errors.New("--audio-column-position must be -1 or more")
+	}
+	flushRows, flushInterval, err := parseFlushInterval(options.FlushInterval)
+	if err != nil {
+		return nil, err
+	}
+	var textTmpl *textTemplate
+	if options.TextTemplate != "" {
+		if textTmpl, err = newTextTemplate(options.TextTemplate); err != nil {
+			return nil, err
+		}
+	}
+	var substitutions []substitution
+	if options.Substitutions != "" {
+		if substitutions, err = loadSubstitutions(options.Substitutions); err != nil {
+			return nil, fmt.Errorf("--substitutions: %w", err)
+		}
+	}
+	if options.StatsJSON != "" && options.StatsInterval <= 0 {
+		return nil, errors.New("--stats-interval must be longer than 0s")
+	}
+	var rotateBytes uint64
+	if options.OutputRotateBytes != "" {
+		if rotateBytes, err = parseByteSize(options.OutputRotateBytes); err != nil {
+			return nil, fmt.Errorf("--output-rotate-bytes: %w", err)
+		}
+	}
+	if options.OutputRotateRows < 0 {
+		return nil, errors.New("--output-rotate-rows can't be negative")
+	}
+	rotating := options.OutputRotateRows > 0 || rotateBytes > 0
+	if rotating && (isStdio(options.Output) || options.Resume || options.RetryFailed != "") {
+		return nil, errors.New(
+			"--output-rotate-rows and --output-rotate-bytes need --output to be a file, and can't be combined with --resume or --retry-failed")
+	}
+	var minFreeDisk uint64
+	if options.MinFreeDisk != "" {
+		if options.AudioOut == "" {
+			return nil, errors.New("--min-free-disk needs --audio-out")
+		}
+		if minFreeDisk, err = parseByteSize(options.MinFreeDisk); err != nil {
+			return nil, fmt.Errorf("--min-free-disk: %w", err)
+		}
+	}
+	if options.PriceStandard < 0 || options.PriceNeural < 0 ||
+		options.PriceLongForm < 0 || options.PriceGenerative < 0 {
+		return nil, errors.New("prices can't be negative")
+	}
+	if options.Neural && options.Engine != string(types.EngineStandard) &&
+		options.Engine != string(types.EngineNeural) {
+		return nil, errors.New("--neural can't be combined with --engine")
+	}
+	if options.StrictCharacters && !options.ReportUnsupportedCharacters {
+		return nil, errors.New("--strict-characters needs --report-unsupported-characters")
+	}
+	engine := options.Engine
+	if options.Neural {
+		engine = string(types.EngineNeural)
+	}
+	if options.VoiceEngineFallback && engine == string(types.EngineStandard) {
+		return nil, errors.New("--voice-engine-fallback needs an --engine other than standard")
+	}
+	if options.SpeakingStyle != "" && engine != string(types.EngineNeural) {
+		return nil, fmt.Errorf(
+			"--speaking-style needs the neural engine, not %s", engine)
+	}
+
+	// How many columns are added to each input row in the output.
+	extraColumns := 1
+	if !options.Async {
+		perVoice := 1
+		if len(speechMarkTypes) > 0 {
+			perVoice++
+		}
+		if options.Subtitles != "" {
+			perVoice++
+		}
+		if options.WriteMeta {
+			perVoice++
+		}
+		if options.RequestIDs {
+			perVoice++
+		}
+		if options.EmitVoice {
+			perVoice++
+		}
+		if options.VoiceEngineFallback || options.EmitEngine {
+			perVoice++
+		}
+		if options.FallbackColumn != "" {
+			perVoice++
+		}
+		extraColumns = perVoice * len(voices)
+		if matrix {
+			extraColumns = perVoice + 1
+		}
+	}
+	if options.EmitCharCount {
+		extraColumns++
+	}
+
+	return &runState{
+		options:         options,
+		inputs:          inputs,
+		audioBucket:     audioBucket,
+		audioPrefix:     audioPrefix,
+		matrix:          matrix,
+		voices:          voices,
+		speechMarkTypes: speechMarkTypes,
+		engine:          engine,
+		audioExt:        audioExt,
+		fileFormat:      fileFormat,
+		pollyParams:     pollyParams,
+		column:          column,
+		voiceColumn:     voiceColumn,
+		languageColumn:  languageColumn,
+		ssmlColumn:      ssmlColumn,
+		fallbackColumn:  fallbackColumn,
+		textColumns:     textColumns,
+		delimiter:       delimiter,
+		comment:         comment,
+		inputEncoding:   inputEncoding,
+		flushRows:       flushRows,
+		flushInterval:   flushInterval,
+		textTmpl:        textTmpl,
+		substitutions:   substitutions,
+		rotateBytes:     rotateBytes,
+		rotating:        rotating,
+		minFreeDisk:     minFreeDisk,
+		extraColumns:    extraColumns,
+		partitions:      make(map[string]*partition),
+		occurrences:     make(map[string]*occurrence),
+	}, nil
 }
 
-func printErrAndExit(err error) {
-	fmt.Fprintf(os.Stderr, "%v", err)
-	os.Exit(1)
+// setUpPolly makes the clients of Polly and S3 the run calls, and checks the
+// voices and lexicons it asks for before any of the input is read.
+func (st *runState) setUpPolly() error {
+	options := st.options
+	var err error
+	// A missing region or credentials is reported before any of the input is
+	// read, rather than by the first request for it. A dry run, which
+	// --count-only is too, doesn't call AWS unless its audio is in S3, so it
+	// needs neither.
+	var awsConfig aws.Config
+	if options.AWSConfig != nil {
+		awsConfig = *options.AWSConfig
+	} else if (options.Polly == nil && !options.DryRun) || st.audioBucket != "" {
+		if awsConfig, err = NewAWSConfig(st.ctx, options); err != nil {
+			return err
+		}
+	}
+
+	// Rows with unsupported characters are reported before anything is
+	// spent on them, which needs the input read through once beforehand.
+	if options.ReportUnsupportedCharacters {
+		for _, input := range st.inputs {
+			if isStdio(input) {
+				return errors.New(
+					"--report-unsupported-characters reads the input twice, so it can't be stdin")
+			}
+		}
+		problems, err := CheckCharacters(st.ctx, *options)
+		if err != nil {
+			return err
+		}
+		for _, problem := range problems {
+			st.log.logf(logNormal, "%v", problem)
+		}
+		if len(problems) > 0 && options.StrictCharacters {
+			return fmt.Errorf(
+				"%d rows have unsupported characters; nothing was synthesized",
+				len(problems))
+		}
+	}
+
+	pollyClient := options.Polly
+	if pollyClient == nil {
+		pollyClient = newPollyClient(awsConfig)
+	}
+	var store *audioStore
+	if st.audioBucket != "" {
+		store = newAudioStore(awsConfig, st.audioBucket, options.Endpoint != "")
+		if options.S3ListExisting && !options.Force {
+			if err := store.listExisting(st.ctx, st.audioPrefix); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Check the voices up front, rather than having every row fail. A dry
+	// run makes no Polly calls at all, so it skips this.
+	var voiceCatalog voiceCatalog
+	// With --auto-language a voice is used in its own language if it doesn't
+	// speak the one asked for.
+	language := options.Language
+	if options.AutoLanguage {
+		language = ""
+	}
+	if !options.DryRun {
+		var err error
+		if voiceCatalog, err = loadVoiceCatalog(st.ctx, pollyClient); err != nil {
+			return err
+		}
+		for _, voice := range st.voices {
+			if voice == "" {
+				continue
+			}
+			if err := st.checkVoice(voiceCatalog, voice, language); err != nil {
+				return err
+			}
+		}
+		for _, name := range options.Lexicons {
+			_, err := pollyClient.GetLexicon(
+				st.ctx,
+				&polly.GetLexiconInput{Name: aws.String(name)})
+			if err != nil {
+				return fmt.Errorf("lexicon %q: %w", name, err)
+			}
+		}
+		if options.Warmup {
+			err := warmUp(st.ctx, pollyClient, voiceCatalog, st.voices[0], st.engine, options.Format)
+			if err != nil {
+				return fmt.Errorf("--warmup: %w", err)
+			}
+		}
+	}
+
+	pricePerMillion := engines[st.engine].pricePerMillion
+	prices := map[string]float64{
+		string(types.EngineStandard): options.PriceStandard,
+		string(types.EngineNeural):   options.PriceNeural,
+		engineLongForm:               options.PriceLongForm,
+		engineGenerative:             options.PriceGenerative,
+	}
+	if prices[st.engine] > 0 {
+		pricePerMillion = prices[st.engine]
+	}
+	st.pollyClient = pollyClient
+	st.store = store
+	st.voiceCatalog = voiceCatalog
+	st.pricePerMillion = pricePerMillion
+	return nil
 }
 
-type fetchAudioParams struct {
-	pollyClient *polly.Polly
-	rateLimiter ratelimit.Limiter
-	waitGroup   *sync.WaitGroup
+// checkVoice returns an error unless voice speaks language with the run's
+// engine, or with the standard engine if it can fall back to that, and has the
+// speaking style if one was asked for.
+func (st *runState) checkVoice(catalog voiceCatalog, voice string, language string) error {
+	options := st.options
+	err := catalog.check(voice, language, st.engine)
+	if err != nil && options.VoiceEngineFallback && options.SpeakingStyle == "" &&
+		catalog.check(voice, language, string(types.EngineStandard)) == nil {
+		return nil
+	}
+	if err == nil && options.SpeakingStyle != "" {
+		err = checkSpeakingStyle(voice, options.SpeakingStyle)
+	}
+	return err
 }
 
-func fetchAudio(
-	text string,
-	languageCode string,
-	voice string,
-	useNeural bool,
-	audioFilepath string,
-	params *fetchAudioParams,
-) {
-	defer params.waitGroup.Done()
-	input := &polly.SynthesizeSpeechInput{
-		OutputFormat: aws.String("mp3"),
-		Text:         aws.String(text),
-		VoiceId:      aws.String(voice),
-		LanguageCode: aws.String(languageCode)}
+// useHeader resolves the columns given by name in header, the first record of
+// the input, and works out the output's header from it.
+func (st *runState) useHeader(header []string) error {
+	options := st.options
+	var err error
+	if st.column, err = resolveColumn(options.Column, header); err != nil {
+		return fmt.Errorf("--column: %w", err)
+	}
+	if st.voiceColumn, err = resolveColumn(options.VoiceColumn, header); err != nil {
+		return fmt.Errorf("--voice-column: %w", err)
+	}
+	if st.languageColumn, err = resolveColumn(options.LanguageColumn, header); err != nil {
+		return fmt.Errorf("--language-column: %w", err)
+	}
+	if st.ssmlColumn, err = resolveColumn(options.SSMLColumn, header); err != nil {
+		return fmt.Errorf("--ssml-column: %w", err)
+	}
+	if st.fallbackColumn, err = resolveColumn(options.FallbackColumn, header); err != nil {
+		return fmt.Errorf("--fallback-column: %w", err)
+	}
+	if st.textColumns, err = resolveColumns(options.TextColumns, header); err != nil {
+		return fmt.Errorf("--text-columns: %w", err)
+	}
 
-	if useNeural {
-		input.Engine = aws.String(polly.EngineNeural)
+	st.header = header
+	st.outputHeader = append([]string(nil), header...)
+	if options.EmitCharCount {
+		st.outputHeader = append(st.outputHeader, "billable_chars")
+	}
+	if options.Async {
+		st.outputHeader = append(st.outputHeader, options.AudioColumnName)
 	} else {
-		input.Engine = aws.String(polly.EngineStandard)
+		// Each of the voices of --voices has the same columns it
+		// would have by itself.
+		headerVoices := st.voices
+		if st.matrix {
+			st.outputHeader = append(st.outputHeader, "voice")
+			headerVoices = st.voices[:1]
+		}
+		for _, voice := range headerVoices {
+			suffix := ""
+			if len(options.CompareVoices) > 0 && !st.matrix {
+				suffix = "_" + voice
+			}
+			st.outputHeader = append(st.outputHeader, options.AudioColumnName+suffix)
+			if options.WriteMeta {
+				st.outputHeader = append(st.outputHeader, "audio_bytes"+suffix)
+			}
+			if options.RequestIDs {
+				st.outputHeader = append(st.outputHeader, "request_ids"+suffix)
+			}
+			if options.EmitVoice {
+				st.outputHeader = append(st.outputHeader, "voice"+suffix)
+			}
+			if options.VoiceEngineFallback || options.EmitEngine {
+				st.outputHeader = append(st.outputHeader, "engine"+suffix)
+			}
+			if options.FallbackColumn != "" {
+				st.outputHeader = append(st.outputHeader, "text_used"+suffix)
+			}
+			if len(st.speechMarkTypes) > 0 {
+				st.outputHeader = append(st.outputHeader, "speech_marks"+suffix)
+			}
+			if options.Subtitles != "" {
+				st.outputHeader = append(st.outputHeader, "subtitles"+suffix)
+			}
+		}
+	}
+	if len(st.textColumns) > 0 {
+		// Each text column has the columns --column would, named after
+		// it.
+		added := st.outputHeader[len(header):]
+		st.outputHeader = append([]string(nil), header...)
+		for _, c := range st.textColumns {
+			if c >= len(header) {
+				return fmt.Errorf("--text-columns: column %d isn't in the header", c)
+			}
+			for _, name := range added {
+				st.outputHeader = append(st.outputHeader, name+"_"+header[c])
+			}
+		}
 	}
+	return nil
+}
 
-	params.rateLimiter.Take()
-	pollyResponse, err := params.pollyClient.SynthesizeSpeech(input)
-	if err != nil {
-		printErrAndExit(err)
+// setUpOutput checks the naming of the audio files, reads what the output is
+// checked against, and without partitioning creates the output file, even if
+// the input turns out to be empty.
+func (st *runState) setUpOutput() error {
+	options := st.options
+	if options.FilenameColumn != "" && options.Naming != "sha1" {
+		return errors.New("--filename-column can't be combined with --naming")
 	}
-	outputFile, err := os.Create(audioFilepath)
+	var err error
+	st.namer, err = newAudioNamer(options.Naming, options.FilenameColumn, st.header)
 	if err != nil {
-		printErrAndExit(err)
+		return err
 	}
-	defer outputFile.Close()
-	_, err = io.Copy(outputFile, pollyResponse.AudioStream)
-	if err != nil {
-		printErrAndExit(err)
+	if options.ShardDepth < 0 {
+		return errors.New("--shard-depth can't be negative")
+	} else if options.ShardDepth > 0 && !st.namer.hashed() {
+		return errors.New("--shard-depth needs a hash --naming scheme")
 	}
+	if options.HashParams && !st.namer.hashed() {
+		return errors.New("--hash-params needs a hash --naming scheme")
+	}
+
+	// The text's column in an output has moved along if the added columns are
+	// inserted before it.
+	st.outputColumn = st.column
+	if options.AudioColumnPosition >= 0 && options.AudioColumnPosition <= st.column {
+		st.outputColumn += st.extraColumns
+	}
+	if len(options.SkipExistingInOutput) > 0 {
+		st.earlierRows, err = readEarlierOutputs(
+			options.SkipExistingInOutput,
+			st.outputColumn,
+			st.delimiter,
+			options.Header)
+		if err != nil {
+			return fmt.Errorf("--skip-existing-in-output: %w", err)
+		}
+	}
+
+	st.compressOutput = options.Gzip || strings.HasSuffix(options.Output, ".gz")
+	st.outputFormat = CSVWriteOptions{
+		Delimiter:     st.delimiter,
+		AlwaysQuote:   options.AlwaysQuote,
+		UseCRLF:       options.CRLF,
+		FlushRows:     st.flushRows,
+		FlushInterval: st.flushInterval,
+	}
+	if options.PartitionBy == "" {
+		// Without partitioning the output file is created even if the input
+		// turns out to be empty.
+		if _, err := st.partition(""); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func main() {
-	var options opts
+// partition returns the partition of the output rows with key are written to,
+// creating its output file, and its audio directory, the first time it's
+// asked for. Without partitioning every row shares the one with key "".
+func (st *runState) partition(key string) (*partition, error) {
+	options := st.options
+	if p, ok := st.partitions[key]; ok {
+		return p, nil
+	}
+	outputPath := options.Output
+	audioDir := options.AudioOut
+	if st.store != nil {
+		// In S3 the audio directory is a key prefix.
+		audioDir = st.audioPrefix
+	}
+	if options.PartitionBy != "" {
+		outputPath = partitionedOutputPath(options.Output, key)
+		if st.store != nil {
+			audioDir = path.Join(st.audioPrefix, key)
+		} else {
+			audioDir = filepath.Join(options.AudioOut, key)
+			if err := os.MkdirAll(audioDir, 0755); err != nil {
+				return nil, err
+			}
+		}
+	}
+	p := &partition{
+		records:   make(chan CSVRecord),
+		writeDone: make(chan error, 1),
+		audioDir:  audioDir,
+	}
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if options.Resume {
+		var err error
+		p.resumed, p.resumedColumns, err = readCompletedKeys(
+			outputPath,
+			st.outputColumn,
+			st.delimiter,
+			st.compressOutput,
+			options.CRLF)
+		if err != nil {
+			return nil, err
+		}
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	openOutput := func(outputPath string) (*os.File, error) {
+		if !options.Resume && !options.OverwriteOutput {
+			// Devices such as /dev/null are fine to write to again.
+			if info, err := os.Stat(outputPath); err == nil && info.Mode().IsRegular() {
+				return nil, fmt.Errorf(
+					"%s already exists; pass --overwrite-output to replace it or --resume to add to it",
+					outputPath)
+			}
+		}
+		return os.OpenFile(outputPath, flag, 0644)
+	}
+	outputfile := os.Stdout
+	partName := func(part int) string {
+		return partitionedOutputPath(outputPath, fmt.Sprintf("%04d", part))
+	}
+	if st.rotating {
+		// Each part is opened as it's reached, but an existing first
+		// part is found before any work is done.
+		outputfile = nil
+		if !options.OverwriteOutput {
+			if info, err := os.Stat(partName(1)); err == nil && info.Mode().IsRegular() {
+				return nil, fmt.Errorf(
+					"%s already exists; pass --overwrite-output to replace it",
+					partName(1))
+			}
+		}
+	} else if !isStdio(outputPath) {
+		var err error
+		if outputfile, err = openOutput(outputPath); err != nil {
+			return nil, err
+		}
+	}
+	p.file = outputfile
+	// Rows are put together with the added columns at the end, and
+	// moved into place on their way to be written.
+	var written <-chan CSVRecord = p.records
+	writesHeader := st.outputHeader != nil && (!options.Resume || p.resumedColumns < 0)
+	addedColumns := st.extraColumns
+	if len(st.textColumns) > 0 {
+		written = mergeTextColumns(written, len(st.textColumns), st.extraColumns, writesHeader)
+		addedColumns *= len(st.textColumns)
+	}
+	if st.matrix {
+		written = splitVoices(written, st.voices, st.extraColumns-1, writesHeader)
+	}
+	if options.AudioColumnPosition >= 0 {
+		written = placeColumns(written, addedColumns, options.AudioColumnPosition)
+	}
+	go func() {
+		if st.rotating {
+			var err error
+			p.parts, err = writeRotatedCSV(
+				func(part int) (io.WriteCloser, string, error) {
+					name := partName(part)
+					f, err := openOutput(name)
+					return f, name, err
+				},
+				st.compressOutput,
+				st.outputFormat,
+				options.OutputRotateRows,
+				int64(st.rotateBytes),
+				writesHeader,
+				written)
+			p.writeDone <- err
+		} else if st.compressOutput {
+			p.writeDone <- WriteGzipCSV(outputfile, st.outputFormat, written)
+		} else {
+			p.writeDone <- WriteCSV(outputfile, st.outputFormat, written)
+		}
+	}()
+	if writesHeader {
+		// An output being resumed already has its header.
+		p.records <- CSVRecord{lineNo: 1, record: st.outputHeader}
+	}
+	st.partitions[key] = p
+	return p, nil
+}
 
-	var parser = flags.NewParser(&options, flags.Default)
-	if _, err := parser.Parse(); err != nil {
-		if flagErr, ok := err.(*flags.Error); ok && flagErr.Type == flags.ErrHelp {
-			os.Exit(0)
+// setUpFetching makes the parameters the fetch workers share.
+func (st *runState) setUpFetching() {
+	options := st.options
+	jitterSource := options.JitterSource
+	if jitterSource == nil {
+		var seed int64
+		if options.Seed != nil {
+			seed = *options.Seed
+		} else {
+			seed = time.Now().UnixNano()
+			st.log.logf(logInfo, "random seed %d; pass --seed %d to repeat it", seed, seed)
 		}
-		os.Exit(1)
+		jitterSource = rand.NewSource(seed)
+	}
+
+	st.clock = options.Clock
+	if st.clock == nil {
+		st.clock = realClock{}
+	}
+	if options.MaxRuntime > 0 {
+		st.deadline = st.clock.Now().Add(options.MaxRuntime)
+	}
+	// Rows handled out of order are all read before any is written, so there's
+	// no point limiting how many can wait.
+	st.reordering = options.Order != "original"
+	orderWindow := outputReorderWindow
+	if st.reordering {
+		orderWindow = 0
+	}
+	st.fetchParams = &fetchAudioParams{
+		ctx:              st.ctx,
+		pollyClient:      st.pollyClient,
+		waitGroup:        &sync.WaitGroup{},
+		rateLimiters:     newRateLimiters(options, st.engine, st.clock),
+		clock:            st.clock,
+		jitter:           newJitter(jitterSource),
+		costs:            newCostTracker(st.pricePerMillion),
+		stats:            &runStats{},
+		retries:          newRetryBudget(options.RetryBudget),
+		maxRetries:       options.MaxRetries,
+		requestTimeout:   options.RequestTimeout,
+		retryDelay:       options.RetryBaseDelay,
+		maxChars:         options.MaxChars,
+		splitStrategy:    options.SplitStrategy,
+		chunkGapMs:       options.ChunkGapMs,
+		errChan:          make(chan rowError),
+		log:              st.log,
+		orderer:          newRowOrderer(orderWindow),
+		jobs:             make(chan fetchJob),
+		prosody:          prosodyAttrs(options.ProsodyRate, options.Pitch, options.Volume),
+		speakingStyle:    options.SpeakingStyle,
+		format:           options.Format,
+		sampleRate:       options.SampleRate,
+		wav:              options.WAV,
+		lexicons:         options.Lexicons,
+		pollyParams:      st.pollyParams,
+		async:            options.Async,
+		s3Bucket:         options.S3Bucket,
+		s3Prefix:         options.S3Prefix,
+		audioStore:       st.store,
+		speechMarks:      st.speechMarkTypes,
+		subtitles:        options.Subtitles,
+		subtitleMaxChars: options.SubtitleMaxChars,
+		voiceCatalog:     st.voiceCatalog,
+		autoLanguage:     options.AutoLanguage,
+		engineFallback:   options.VoiceEngineFallback,
+		retryEmptyAudio:  options.RetryOnEmptyAudio,
+		contentTypeExt:   options.ContentTypeExtension,
+		requestIDs:       options.RequestIDs,
 	}
 
-	sess := session.Must(session.NewSessionWithOptions(
-		session.Options{
-			SharedConfigState: session.SharedConfigEnable,
-			Config:            aws.Config{Region: aws.String(options.Region)},
-		}))
+	if options.Bench {
+		st.fetchParams.timings = &requestTimings{}
+	}
+}
 
-	pollyClient := polly.New(sess)
+// collectFailures collects the failed rows sent on the fetch workers' errChan
+// until it's closed, writing them to the error output if there is one, and
+// closes the channel it returns once it's done. With --fail-fast the first
+// stops the run, as an error that couldn't be carried on from, and with
+// --max-failures the one that reaches it does.
+func (st *runState) collectFailures(jsonErrors *jsonErrorWriter) <-chan struct{} {
+	options := st.options
+	fetchErrsDone := make(chan struct{})
+	go func() {
+		for err := range st.fetchParams.errChan {
+			if err.dropped {
+				st.droppedRows = append(st.droppedRows, rowLocation{err.input, err.lineNo})
+				continue
+			}
+			st.log.rowf(logInfo, err.lineNo, "", "failed: %v", err.err)
+			st.fetchParams.stats.add(rowFailed)
+			st.fetchErrs = append(st.fetchErrs, err)
+			if options.FailFast && st.failFastErr == nil {
+				st.failFastErr = fmt.Errorf("--fail-fast: %w", err)
+				st.cancel()
+			} else if options.MaxFailures > 0 && len(st.fetchErrs) == options.MaxFailures && st.failFastErr == nil {
+				st.failFastErr = fmt.Errorf("--max-failures: %d rows failed, the last being %w", len(st.fetchErrs), err)
+				st.cancel()
+			}
+			if st.errorWriter != nil {
+				failed := []string{strconv.Itoa(err.lineNo), err.text, err.err.Error()}
+				if len(st.inputs) > 1 {
+					// Line numbers alone don't say which input a row came from.
+					failed = append([]string{err.input}, failed...)
+				}
+				st.errorWriter.Write(failed)
+			}
+			if jsonErrors != nil {
+				jsonErrors.writeRow(err)
+			}
+		}
+		close(fetchErrsDone)
+	}()
+	return fetchErrsDone
+}
 
-	var maxRequestsPerSecond int
-	if options.Neural {
-		maxRequestsPerSecond = 8
-	} else {
-		maxRequestsPerSecond = 80
+// handleRows handles each of the records received on records, which readDone
+// receives the reader's error on once it's done, until the input is exhausted
+// or the run is stopped. It returns whether the run was interrupted, and the
+// error that stopped it if any.
+func (st *runState) handleRows(records <-chan CSVRecord, readDone <-chan error, stopReading func()) (bool, error) {
+	options := st.options
+	rows := records
+	if st.reordering {
+		ordered := make(chan CSVRecord)
+		go reorderRecords(st.ctx, options.Order, st.column, st.fetchParams.jitter, records, ordered)
+		rows = ordered
+	}
+	interrupted := false
+	var runErr error
+	for r := range rows {
+		if st.ctx.Err() != nil {
+			// The reader stops too, once ctx is done.
+			interrupted = true
+			break
+		}
+		if st.reordering {
+			st.fetchParams.orderer.place(r.seq)
+		}
+		if len(st.textColumns) > 0 {
+			runErr = st.handleTextColumns(r)
+		} else {
+			runErr = st.handleRecord(r)
+		}
+		if runErr != nil {
+			// The row that stopped the run is left to be retried again.
+			delete(st.retriedRows, rowLocation{r.input, r.lineNo})
+			st.cancel()
+			break
+		}
+		if st.previewed != nil {
+			break
+		}
 	}
+	if runErr == nil && st.ctx.Err() == nil {
+		if st.previewed != nil {
+			// The rest of the input is left unread.
+			stopReading()
+			for range rows {
+			}
+			<-readDone
+		} else if runErr = <-readDone; runErr != nil {
+			st.cancel()
+		} else if options.Preview {
+			runErr = errors.New("--preview: no row has text to synthesize")
+		}
+	}
+	return interrupted, runErr
+}
 
-	seen := make(map[string]int)
+// handleTextColumns handles a row as one row for each of --text-columns,
+// each ending with the marker of the row and column it's for.
+func (st *runState) handleTextColumns(r CSVRecord) error {
+	st.textRows++
+	defer func() { st.textColumn = 0 }()
+	for i, c := range st.textColumns {
+		st.column, st.textColumn = c, i
+		row := r
+		row.record = make([]string, 0, len(r.record)+1)
+		row.record = append(row.record, r.record...)
+		row.record = append(row.record, textColumnMarker(st.textRows, i))
+		if err := st.handleRecord(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	inputfile, err := os.Open(options.Input)
-	if err != nil {
-		printErrAndExit(err)
+// finish waits for everything the run started, once no more rows are to be
+// dispatched, and returns the names of the output's parts if it was rotated
+// and runErr, or the first error that finishing ran into if it's nil.
+func (st *runState) finish(runErr error, fetchErrsDone <-chan struct{}) ([]string, error) {
+	close(st.fetchParams.jobs)
+	st.fetchParams.waitGroup.Wait()
+	st.fetchParams.orderer.close()
+	close(st.fetchParams.errChan)
+	<-fetchErrsDone
+	if st.failFastErr != nil && runErr == nil {
+		runErr = st.failFastErr
+	}
+	if st.errorWriter != nil {
+		if st.retryErrorFile != nil {
+			st.writeUnfinished()
+		}
+		st.errorWriter.Flush()
+		err := st.errorWriter.Error()
+		if err == nil && st.retryErrorFile != nil {
+			if err = st.retryErrorFile.Close(); err == nil {
+				err = os.Rename(st.retryErrorFile.Name(), st.options.RetryFailed)
+			}
+		}
+		if err != nil && runErr == nil {
+			runErr = err
+		}
+	}
+	if st.dedupeWriter != nil {
+		st.dedupeWriter.Flush()
+		if err := st.dedupeWriter.Error(); err != nil && runErr == nil {
+			runErr = fmt.Errorf("writing --dedupe-report: %w", err)
+		}
+	}
+	for _, p := range st.partitions {
+		close(p.records)
+		if err := <-p.writeDone; err != nil && runErr == nil {
+			runErr = err
+		}
+		if p.file != nil && p.file != os.Stdout {
+			p.file.Close()
+		}
+	}
+	var outputParts []string
+	if st.rotating {
+		keys := make([]string, 0, len(st.partitions))
+		for key := range st.partitions {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			outputParts = append(outputParts, st.partitions[key].parts...)
+		}
+	}
+	return outputParts, runErr
+}
+
+// writeUnfinished writes the lines of the rows being retried that the run
+// didn't finish to the errors left, so that they're still there to be retried
+// if it was stopped: those it didn't get to, and those whose fetches were
+// dropped.
+func (st *runState) writeUnfinished() {
+	unfinished := append([]rowLocation(nil), st.droppedRows...)
+	for location := range st.retryLines {
+		if !st.retriedRows[location] {
+			unfinished = append(unfinished, location)
+		}
+	}
+	sort.Slice(unfinished, func(i, j int) bool {
+		if unfinished[i].input != unfinished[j].input {
+			return unfinished[i].input < unfinished[j].input
+		}
+		return unfinished[i].lineNo < unfinished[j].lineNo
+	})
+	for _, location := range unfinished {
+		if line, ok := st.retryLines[location]; ok {
+			st.errorWriter.Write(line)
+		}
 	}
-	defer inputfile.Close()
+}
 
-	outputfile, err := os.Create(options.Output)
-	if err != nil {
-		printErrAndExit(err)
+// summarize logs the summary of a run that finished, returning its Result.
+func (st *runState) summarize(interrupted bool, outputParts []string) Result {
+	options := st.options
+	if len(st.fetchErrs) > 0 {
+		st.log.logf(logNormal, "%d rows failed:", len(st.fetchErrs))
+		for _, err := range st.fetchErrs {
+			st.log.logf(logNormal, "  %v", err)
+		}
 	}
-	defer outputfile.Close()
 
-	csvreader := csv.NewReader(inputfile)
-	csvwriter := csv.NewWriter(outputfile)
+	if options.CountOnly {
+		st.log.logf(
+			logNormal,
+			"%d rows, %d unique texts: %d with audio already, %d new",
+			st.countedRows,
+			len(st.occurrences),
+			st.existingTexts,
+			st.newTexts)
+		failures := make([]error, len(st.fetchErrs))
+		for i, err := range st.fetchErrs {
+			failures[i] = err
+		}
+		return Result{
+			Failures:      failures,
+			Interrupted:   interrupted,
+			Rows:          st.countedRows,
+			UniqueTexts:   len(st.occurrences),
+			ExistingTexts: st.existingTexts,
+			NewTexts:      st.newTexts,
+		}
+	}
+	if options.DryRun {
+		st.log.logf(
+			logNormal,
+			"dry run: %d new files, %d cached files, %d characters, estimated cost $%.2f",
+			st.newFiles,
+			st.cachedFiles,
+			st.newChars,
+			float64(st.newChars)*st.pricePerMillion/1e6)
+	}
 
-	fetchParams := fetchAudioParams{
-		pollyClient: pollyClient,
-		waitGroup:   &sync.WaitGroup{},
-		rateLimiter: ratelimit.New(maxRequestsPerSecond),
+	if interrupted {
+		st.log.logf(
+			logNormal,
+			"interrupted: the output only covers the rows dispatched before the interrupt")
 	}
 
-	lineNo := 0
-	numColumns := -1
-	for {
-		lineNo++
-		record, err := csvreader.Read()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			printErrAndExit(err)
-		}
-
-		recordLen := len(record)
-		if recordLen == 0 {
-			printErrAndExit(fmt.Errorf(
-				"empty record found on line %d",
-				lineNo))
-		}
-
-		// If this is the first line, then set the expected columns. All lines
-		// should have the same number of columns.
-		if numColumns == -1 {
-			numColumns = recordLen
-		} else if numColumns != recordLen {
-			printErrAndExit(
-				fmt.Errorf(
-					"expected %d columns but found %d columns on line %d",
-					numColumns,
-					recordLen,
-					lineNo))
-		}
-
-		if lastSeenLineNo, ok := seen[record[0]]; ok {
-			printErrAndExit(
-				fmt.Errorf(
-					"duplicate \"%s\" found on line %d, previously on line %d",
-					record[0],
-					lineNo,
-					lastSeenLineNo))
-		} else {
-			seen[record[0]] = lineNo
-		}
-
-		// Figure out what the audio filename and path should be.
-		h := sha1.New()
-		h.Write([]byte(record[0]))
-
-		audioFilename := fmt.Sprintf("%x.mp3", h.Sum(nil))
-		audioFilepath := filepath.Join(options.AudioOut, audioFilename)
-		outputRecord := append(record, audioFilename)
-
-		if _, err := os.Stat(audioFilepath); err == nil {
-			// File exists. Just write the output and we're done.
-			csvwriter.Write(outputRecord)
-			continue
-		} else if errors.Is(err, os.ErrNotExist) {
-			// File doesn't exist, so spawn the job to fetch it.
-			fetchParams.waitGroup.Add(1)
-			go fetchAudio(
-				record[0],
-				options.Language,
-				options.Voice,
-				options.Neural,
-				audioFilepath,
-				&fetchParams,
-			)
-			csvwriter.Write(outputRecord)
-		} else {
-			// Some other error.
-			printErrAndExit(err)
+	if st.ceilingReached {
+		st.log.logf(
+			logNormal,
+			"cost ceiling reached: $%.2f spent, %d rows remaining",
+			st.fetchParams.costs.cost(),
+			st.remainingRows)
+	}
+	if st.budgetReached {
+		st.log.logf(
+			logNormal,
+			"character budget reached: %d characters dispatched for %d rows, %d rows remaining",
+			st.dispatchedChars,
+			st.fetchParams.stats.count(rowSynthesized)+st.fetchParams.stats.count(rowFailed),
+			st.remainingRows)
+	}
+
+	if st.deadlineReached {
+		st.log.logf(
+			logNormal,
+			"deadline reached: stopped after %v, %d rows remaining",
+			options.MaxRuntime,
+			st.remainingRows)
+	}
+
+	stats := st.fetchParams.stats
+	st.log.logf(
+		logNormal,
+		"%d rows synthesized, %d cached, %d already in the output, %d duplicates skipped, %d failed; %d characters billed, $%.2f",
+		stats.count(rowSynthesized),
+		stats.count(rowCached),
+		stats.count(rowSkipped),
+		stats.count(rowDuplicate),
+		stats.count(rowFailed),
+		st.fetchParams.costs.characters(),
+		st.fetchParams.costs.cost())
+	if options.MaxDuplicateLog > 0 && st.duplicatesNoticed > options.MaxDuplicateLog {
+		st.log.logf(
+			logDebug,
+			"%d more duplicates weren't logged, past --max-duplicate-log",
+			st.duplicatesNoticed-options.MaxDuplicateLog)
+	}
+	if n := stats.count(rowTooLong); n > 0 {
+		st.log.logf(logNormal, "%d rows skipped as longer than --text-max-bytes", n)
+	}
+	if len(st.previewed) > 0 && len(st.fetchErrs) == 0 {
+		sampleRate := "the default sample rate"
+		if options.SampleRate != "" {
+			sampleRate = options.SampleRate + " Hz"
+		}
+		for _, job := range st.previewed {
+			destination := job.audioFilepath
+			if job.audioKey != "" {
+				destination = st.fetchParams.audioStore.uri(job.audioKey)
+			}
+			st.log.logf(
+				logNormal,
+				"preview: line %d synthesized by %s (%s engine, %s) as %s at %s, written to %s",
+				st.previewLine,
+				job.voice,
+				job.engine,
+				job.languageCode,
+				options.Format,
+				sampleRate,
+				destination)
+		}
+	}
+
+	if st.fetchParams.timings != nil {
+		requests, bytes := st.fetchParams.timings.totals()
+		elapsed := st.clock.Now().Sub(st.reporter.start)
+		st.log.logf(
+			logNormal,
+			"bench: %d requests and %d bytes in %v, %.1f requests/s and %.0f bytes/s; latency p50 %v, p95 %v",
+			requests,
+			bytes,
+			elapsed.Round(time.Millisecond),
+			float64(requests)/elapsed.Seconds(),
+			float64(bytes)/elapsed.Seconds(),
+			st.fetchParams.timings.percentile(50).Round(time.Millisecond),
+			st.fetchParams.timings.percentile(95).Round(time.Millisecond))
+		rateWait, pollyTime := st.fetchParams.timings.waits()
+		waitShare := 0.0
+		if rateWait+pollyTime > 0 {
+			waitShare = 100 * rateWait.Seconds() / (rateWait + pollyTime).Seconds()
+		}
+		st.log.logf(
+			logNormal,
+			"bench: %v waiting on the rate limit and %v in requests to Polly, summed over the workers; %.0f%% of their time was spent waiting",
+			rateWait.Round(time.Millisecond),
+			pollyTime.Round(time.Millisecond),
+			waitShare)
+	}
+
+	if st.matrix && !options.DryRun {
+		st.log.logf(
+			logNormal,
+			"%d output rows, one for each of %d voices",
+			(stats.count(rowSynthesized)+stats.count(rowCached))*len(st.voices),
+			len(st.voices))
+	}
+	if len(options.CompareVoices) > 0 {
+		for _, voice := range st.voices {
+			chars, cost := st.fetchParams.costs.voiceTotals(voice)
+			st.log.logf(
+				logNormal,
+				"%s: %d characters, $%.2f",
+				voice,
+				chars,
+				cost)
 		}
 	}
 
-	csvwriter.Flush()
-	fetchParams.waitGroup.Wait()
+	if options.PartitionBy != "" {
+		keys := make([]string, 0, len(st.partitions))
+		for key := range st.partitions {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			p := st.partitions[key]
+			st.log.logf(
+				logNormal,
+				"%s: %d rows, %d synthesized, %d cached",
+				key,
+				p.rows,
+				p.synthesized,
+				p.cached)
+		}
+	}
+
+	if st.rotating {
+		st.log.logf(
+			logNormal,
+			"output written to %d parts: %s",
+			len(outputParts),
+			strings.Join(outputParts, ", "))
+	}
+
+	failures := make([]error, len(st.fetchErrs))
+	for i, err := range st.fetchErrs {
+		failures[i] = err
+	}
+	return Result{
+		OutputParts:        outputParts,
+		Synthesized:        stats.count(rowSynthesized),
+		Cached:             stats.count(rowCached),
+		Skipped:            stats.count(rowSkipped),
+		Duplicates:         stats.count(rowDuplicate),
+		TooLong:            stats.count(rowTooLong),
+		Failures:           failures,
+		Characters:         st.fetchParams.costs.characters(),
+		Cost:               st.fetchParams.costs.cost(),
+		Interrupted:        interrupted,
+		CostCeilingReached: st.ceilingReached,
+		CharBudgetReached:  st.budgetReached,
+		DeadlineReached:    st.deadlineReached,
+		RemainingRows:      st.remainingRows,
+	}
 }
@@ -0,0 +1,361 @@
+package parrot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/polly"
+	"github.com/aws/aws-sdk-go-v2/service/polly/types"
+	"github.com/aws/smithy-go"
+	"go.uber.org/ratelimit"
+)
+
+// fakeSynthesizer is a Synthesizer that returns "audio:" and the text of each
+// request as its audio, recording the requests it's sent.
+type fakeSynthesizer struct {
+	mu     sync.Mutex
+	inputs []*polly.SynthesizeSpeechInput
+	// fail, if set, returns the error a request fails with, or nil if it
+	// succeeds.
+	fail func(input *polly.SynthesizeSpeechInput) error
+}
+
+func (f *fakeSynthesizer) SynthesizeSpeech(
+	ctx context.Context,
+	input *polly.SynthesizeSpeechInput,
+	_ ...func(*polly.Options),
+) (*polly.SynthesizeSpeechOutput, error) {
+	f.mu.Lock()
+	copied := *input
+	f.inputs = append(f.inputs, &copied)
+	f.mu.Unlock()
+	if f.fail != nil {
+		if err := f.fail(input); err != nil {
+			return nil, err
+		}
+	}
+	text := aws.ToString(input.Text)
+	return &polly.SynthesizeSpeechOutput{
+		AudioStream:       ioutil.NopCloser(strings.NewReader("audio:" + text)),
+		ContentType:       aws.String("audio/mpeg"),
+		RequestCharacters: int32(len(text)),
+	}, nil
+}
+
+func (f *fakeSynthesizer) StartSpeechSynthesisTask(
+	context.Context,
+	*polly.StartSpeechSynthesisTaskInput,
+	...func(*polly.Options),
+) (*polly.StartSpeechSynthesisTaskOutput, error) {
+	return nil, errors.New("the fake doesn't run synthesis tasks")
+}
+
+func (f *fakeSynthesizer) GetSpeechSynthesisTask(
+	context.Context,
+	*polly.GetSpeechSynthesisTaskInput,
+	...func(*polly.Options),
+) (*polly.GetSpeechSynthesisTaskOutput, error) {
+	return nil, errors.New("the fake doesn't run synthesis tasks")
+}
+
+func (f *fakeSynthesizer) DescribeVoices(
+	context.Context,
+	*polly.DescribeVoicesInput,
+	...func(*polly.Options),
+) (*polly.DescribeVoicesOutput, error) {
+	engines := []types.Engine{types.EngineStandard, types.EngineNeural}
+	return &polly.DescribeVoicesOutput{Voices: []types.Voice{
+		{Id: "Joanna", LanguageCode: "en-US", SupportedEngines: engines},
+		{Id: "Matthew", LanguageCode: "en-US", SupportedEngines: engines},
+	}}, nil
+}
+
+func (f *fakeSynthesizer) GetLexicon(
+	context.Context,
+	*polly.GetLexiconInput,
+	...func(*polly.Options),
+) (*polly.GetLexiconOutput, error) {
+	return &polly.GetLexiconOutput{}, nil
+}
+
+// requests returns the inputs of the requests the fake has been sent.
+func (f *fakeSynthesizer) requests() []*polly.SynthesizeSpeechInput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*polly.SynthesizeSpeechInput(nil), f.inputs...)
+}
+
+// newTestParams returns the parameters of fetching audio from client with no
+// rate limits, retries or logging.
+func newTestParams(client Synthesizer) *fetchAudioParams {
+	limiters := make(map[string]ratelimit.Limiter, len(engines))
+	for name := range engines {
+		limiters[name] = ratelimit.NewUnlimited()
+	}
+	return &fetchAudioParams{
+		ctx:          context.Background(),
+		pollyClient:  client,
+		rateLimiters: limiters,
+		clock:        realClock{},
+		jitter:       newJitter(rand.NewSource(1)),
+		waitGroup:    &sync.WaitGroup{},
+		costs:        newCostTracker(4),
+		stats:        &runStats{},
+		retries:      newRetryBudget(10),
+		maxChars:     pollyMaxChars,
+		log:          newLogger(ioutil.Discard, logQuiet),
+		format:       string(types.OutputFormatMp3),
+	}
+}
+
+func TestSynthesizeChunkInput(t *testing.T) {
+	tests := []struct {
+		name         string
+		text         string
+		ssml         bool
+		engine       string
+		prosody      string
+		wantText     string
+		wantTextType types.TextType
+	}{
+		{
+			name:     "standard",
+			text:     "hello & goodbye",
+			engine:   "standard",
+			wantText: "hello & goodbye",
+		},
+		{
+			name:     "neural",
+			text:     "hello",
+			engine:   "neural",
+			wantText: "hello",
+		},
+		{
+			name:         "ssml",
+			text:         "<speak>hello</speak>",
+			ssml:         true,
+			engine:       "neural",
+			wantText:     "<speak>hello</speak>",
+			wantTextType: types.TextTypeSsml,
+		},
+		{
+			name:         "plain text with prosody",
+			text:         "hello & goodbye",
+			engine:       "standard",
+			prosody:      `rate="slow"`,
+			wantText:     `<speak><prosody rate="slow">hello &amp; goodbye</prosody></speak>`,
+			wantTextType: types.TextTypeSsml,
+		},
+		{
+			name:         "ssml with prosody",
+			text:         "<speak>hello</speak>",
+			ssml:         true,
+			engine:       "neural",
+			prosody:      `rate="slow"`,
+			wantText:     `<speak><prosody rate="slow">hello</prosody></speak>`,
+			wantTextType: types.TextTypeSsml,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := &fakeSynthesizer{}
+			params := newTestParams(fake)
+			params.prosody = test.prosody
+			job := fetchJob{
+				text:         test.text,
+				ssml:         test.ssml,
+				languageCode: "en-US",
+				voice:        "Joanna",
+				engine:       test.engine,
+				row:          &pendingRow{lineNo: 1},
+			}
+			var audio bytes.Buffer
+			if err := synthesizeChunk(&audio, test.text, job, params, nil); err != nil {
+				t.Fatalf("synthesizeChunk: %v", err)
+			}
+			requests := fake.requests()
+			if len(requests) != 1 {
+				t.Fatalf("got %d requests, want 1", len(requests))
+			}
+			input := requests[0]
+			if got := string(input.Engine); got != test.engine {
+				t.Errorf("Engine = %q, want %q", got, test.engine)
+			}
+			if got := aws.ToString(input.Text); got != test.wantText {
+				t.Errorf("Text = %q, want %q", got, test.wantText)
+			}
+			if input.TextType != test.wantTextType {
+				t.Errorf("TextType = %q, want %q", input.TextType, test.wantTextType)
+			}
+			if input.VoiceId != "Joanna" || input.LanguageCode != "en-US" {
+				t.Errorf("VoiceId, LanguageCode = %q, %q, want Joanna, en-US", input.VoiceId, input.LanguageCode)
+			}
+			if input.OutputFormat != types.OutputFormatMp3 {
+				t.Errorf("OutputFormat = %q, want mp3", input.OutputFormat)
+			}
+			if got, want := audio.String(), "audio:"+test.wantText; got != want {
+				t.Errorf("audio = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRetryBudgetLimitsThrottling(t *testing.T) {
+	fake := &fakeSynthesizer{fail: func(*polly.SynthesizeSpeechInput) error {
+		return &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}
+	}}
+	params := newTestParams(fake)
+	params.maxRetries = 3
+	params.retryDelay = time.Microsecond
+
+	const rows = 200
+	for i := 0; i < rows; i++ {
+		job := fetchJob{
+			text:         "hello",
+			languageCode: "en-US",
+			voice:        "Joanna",
+			engine:       "standard",
+			row:          &pendingRow{lineNo: i + 1},
+		}
+		var audio bytes.Buffer
+		if err := synthesizeChunk(&audio, job.text, job, params, nil); !isThrottle(err) {
+			t.Fatalf("row %d: got %v, want a throttle", i+1, err)
+		}
+	}
+
+	// Every row is tried once, and retries only get the budget's starting
+	// tokens and its share of the requests made since.
+	requests := len(fake.requests())
+	retries := requests - rows
+	if max := maxRetryTokens + int(0.1*float64(requests)) + 1; retries > max {
+		t.Errorf("%d retries of %d rows, want at most %d", retries, rows, max)
+	}
+	if retries < maxRetryTokens {
+		t.Errorf("%d retries, want at least the budget's %d starting tokens", retries, maxRetryTokens)
+	}
+}
+
+func TestRetryBudgetAllowsOccasionalFailures(t *testing.T) {
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	fake := &fakeSynthesizer{fail: func(input *polly.SynthesizeSpeechInput) error {
+		mu.Lock()
+		defer mu.Unlock()
+		text := aws.ToString(input.Text)
+		attempts[text]++
+		if text == "flaky" && attempts[text] <= 2 {
+			return &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}
+		}
+		return nil
+	}}
+	params := newTestParams(fake)
+	params.maxRetries = 3
+	params.retryDelay = time.Microsecond
+
+	for i, text := range []string{"one", "flaky", "two"} {
+		job := fetchJob{
+			text:         text,
+			languageCode: "en-US",
+			voice:        "Joanna",
+			engine:       "standard",
+			row:          &pendingRow{lineNo: i + 1},
+		}
+		var audio bytes.Buffer
+		if err := synthesizeChunk(&audio, text, job, params, nil); err != nil {
+			t.Fatalf("%s: %v", text, err)
+		}
+	}
+	if attempts["flaky"] != 3 {
+		t.Errorf("flaky was attempted %d times, want 3", attempts["flaky"])
+	}
+}
+
+func TestPollyClientMakesOneAttempt(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		mu.Unlock()
+		w.Header().Set("x-amzn-ErrorType", "ThrottlingException")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"message":"Rate exceeded"}`))
+	}))
+	defer server.Close()
+
+	cfg := aws.Config{
+		Region:      "us-east-1",
+		Credentials: aws.NewCredentialsCache(staticCredentials{}),
+		EndpointResolver: aws.EndpointResolverFunc(func(service, region string) (aws.Endpoint, error) {
+			return aws.Endpoint{URL: server.URL, SigningRegion: region}, nil
+		}),
+	}
+	_, err := newPollyClient(cfg).SynthesizeSpeech(context.Background(), &polly.SynthesizeSpeechInput{
+		OutputFormat: types.OutputFormatMp3,
+		Text:         aws.String("hello"),
+		VoiceId:      "Joanna",
+	})
+	if !isThrottle(err) {
+		t.Fatalf("got %v, want a throttle", err)
+	}
+	if attempts != 1 {
+		t.Errorf("the SDK made %d attempts, want 1 so that parrot's retries are the only ones", attempts)
+	}
+}
+
+type staticCredentials struct{}
+
+func (staticCredentials) Retrieve(context.Context) (aws.Credentials, error) {
+	return aws.Credentials{AccessKeyID: "x", SecretAccessKey: "y"}, nil
+}
+
+func TestExtForFormat(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"mp3", ".mp3"},
+		{"ogg_vorbis", ".ogg"},
+		{"pcm", ".pcm"},
+		// Speech marks are json, which isn't an audio format.
+		{"json", ""},
+		{"", ""},
+		{"opus", ""},
+	}
+	for _, test := range tests {
+		if got := extForFormat(test.format); got != test.want {
+			t.Errorf("extForFormat(%q) = %q, want %q", test.format, got, test.want)
+		}
+	}
+}
+
+func TestRunRejectsUnsupportedFormat(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "input.csv"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, format := range []string{"json", "opus"} {
+		fake := &fakeSynthesizer{}
+		options := testRunConfig(dir, fake)
+		options.Format = format
+		_, err := Run(context.Background(), options)
+		if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("--format %q isn't supported", format)) {
+			t.Errorf("--format %s: got %v, want it rejected", format, err)
+		}
+		if requests := len(fake.requests()); requests != 0 {
+			t.Errorf("--format %s: made %d requests, want 0", format, requests)
+		}
+	}
+}
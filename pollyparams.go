@@ -0,0 +1,115 @@
+package parrot
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/polly"
+)
+
+// reservedPollyParams are the request fields parrot sets itself for each
+// request, which --polly-param can't override.
+var reservedPollyParams = map[string]bool{
+	"Text":            true,
+	"TextType":        true,
+	"OutputFormat":    true,
+	"SpeechMarkTypes": true,
+	"Engine":          true,
+	"VoiceId":         true,
+}
+
+// pollyParam is a field of Polly's requests set with --polly-param.
+type pollyParam struct {
+	field  string
+	values []string
+}
+
+// parsePollyParams parses --polly-param values, each a field of
+// polly.SynthesizeSpeechInput or polly.StartSpeechSynthesisTaskInput, as
+// named in the SDK but in any case, and the value to set it to, such as
+// LanguageCode=en-GB. A list field is set to the comma-separated values
+// given, along with those of any other values for it.
+func parsePollyParams(params []string) ([]pollyParam, error) {
+	var parsed []pollyParam
+	index := make(map[string]int)
+	for _, param := range params {
+		eq := strings.Index(param, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("--polly-param %q isn't key=value", param)
+		}
+		key, value := strings.TrimSpace(param[:eq]), param[eq+1:]
+		field, ok := pollyParamField(key)
+		if !ok {
+			return nil, fmt.Errorf("--polly-param %q isn't a string or list of strings field of Polly's requests", key)
+		}
+		if reservedPollyParams[field.Name] {
+			return nil, fmt.Errorf("--polly-param %s is set by parrot; use its own flag", field.Name)
+		}
+		values := []string{value}
+		if field.Type.Kind() == reflect.Slice {
+			values = nil
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					values = append(values, item)
+				}
+			}
+		}
+		if i, ok := index[field.Name]; ok {
+			if field.Type.Kind() != reflect.Slice {
+				return nil, fmt.Errorf("--polly-param %s is given more than once", field.Name)
+			}
+			parsed[i].values = append(parsed[i].values, values...)
+			continue
+		}
+		index[field.Name] = len(parsed)
+		parsed = append(parsed, pollyParam{field: field.Name, values: values})
+	}
+	return parsed, nil
+}
+
+// pollyParamField returns the field of the Polly requests named key, in any
+// case, if it's one --polly-param can set.
+func pollyParamField(key string) (reflect.StructField, bool) {
+	for _, input := range []interface{}{polly.SynthesizeSpeechInput{}, polly.StartSpeechSynthesisTaskInput{}} {
+		t := reflect.TypeOf(input)
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !strings.EqualFold(field.Name, key) {
+				continue
+			}
+			kind := field.Type.Kind()
+			if kind == reflect.Ptr || kind == reflect.Slice {
+				kind = field.Type.Elem().Kind()
+			}
+			return field, kind == reflect.String
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// applyPollyParams sets the fields params names on input, a pointer to one of
+// Polly's request structs, leaving out those it doesn't have.
+func applyPollyParams(input interface{}, params []pollyParam) {
+	v := reflect.ValueOf(input).Elem()
+	for _, param := range params {
+		f := v.FieldByName(param.field)
+		if !f.IsValid() {
+			continue
+		}
+		switch f.Kind() {
+		case reflect.String:
+			f.Set(reflect.ValueOf(param.values[0]).Convert(f.Type()))
+		case reflect.Ptr:
+			p := reflect.New(f.Type().Elem())
+			p.Elem().Set(reflect.ValueOf(param.values[0]).Convert(f.Type().Elem()))
+			f.Set(p)
+		case reflect.Slice:
+			s := reflect.MakeSlice(f.Type(), 0, len(param.values))
+			for _, value := range param.values {
+				s = reflect.Append(s, reflect.ValueOf(value).Convert(f.Type().Elem()))
+			}
+			f.Set(s)
+		}
+	}
+}
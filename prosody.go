@@ -0,0 +1,87 @@
+package parrot
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// prosodyAttrs returns the attributes of an SSML prosody element setting
+// rate, pitch and volume, leaving out any that are empty, or "" if they all
+// are.
+func prosodyAttrs(rate string, pitch string, volume string) string {
+	var attrs []string
+	for _, attr := range []struct{ name, value string }{
+		{"rate", rate},
+		{"pitch", pitch},
+		{"volume", volume},
+	} {
+		if attr.value != "" {
+			attrs = append(attrs, attr.name+`="`+xmlEscape(attr.value)+`"`)
+		}
+	}
+	return strings.Join(attrs, " ")
+}
+
+// maxBreakMs is the longest break Polly allows in SSML.
+const maxBreakMs = 10000
+
+// placeholderBreakMs is how long the silence given to rows with no text by
+// --write-empty-audio-on-empty-text is.
+const placeholderBreakMs = 250
+
+// withBreak returns the plain text as SSML that ends with a break of ms
+// milliseconds.
+func withBreak(text string, ms int) string {
+	return "<speak>" + xmlEscape(text) + `<break time="` + strconv.Itoa(ms) + `ms"/></speak>`
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// requestText returns text, which is SSML if ssml is set, as it's sent to
+// Polly, which is as it is unless there's a speaking style or prosody to
+// apply, along with whether it's SSML. Plain text is escaped and wrapped in
+// speak, amazon:domain and prosody elements, while SSML has the others put
+// just inside its speak element.
+func requestText(text string, ssml bool, params *fetchAudioParams) (string, bool, error) {
+	var before, after string
+	if params.speakingStyle != "" {
+		before = `<amazon:domain name="` + params.speakingStyle + `">`
+		after = "</amazon:domain>"
+	}
+	if params.prosody != "" {
+		before += "<prosody " + params.prosody + ">"
+		after = "</prosody>" + after
+	}
+	if before == "" {
+		return text, ssml, nil
+	}
+	trimmed := strings.TrimSpace(text)
+	if !ssml {
+		if strings.HasPrefix(trimmed, "<speak") {
+			return "", false, errors.New(
+				"text is already SSML; set --ssml to apply a speaking style or prosody to it")
+		}
+		return "<speak>" + before + xmlEscape(text) + after + "</speak>", true, nil
+	}
+	wrapped, err := insideSpeak(text, before, after)
+	return wrapped, true, err
+}
+
+// insideSpeak returns the SSML text with before put just inside its opening
+// speak element and after just inside its closing one.
+func insideSpeak(text string, before string, after string) (string, error) {
+	trimmed := strings.TrimSpace(text)
+	start := strings.Index(trimmed, ">") + 1
+	end := strings.LastIndex(trimmed, "</speak>")
+	if start == 0 || end < start || !strings.HasPrefix(trimmed, "<speak") {
+		return "", errors.New("SSML text must be enclosed in <speak> and </speak>")
+	}
+	return trimmed[:start] + before + trimmed[start:end] + after + trimmed[end:], nil
+}
@@ -0,0 +1,473 @@
+package parrot
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+// CSVRecord is a single input record along with the line it was read from,
+// and which input that was if there's more than one.
+type CSVRecord struct {
+	input  string
+	lineNo int
+	record []string
+	// width is how many columns the record had before it was padded or cut
+	// short to match the first.
+	width int
+	// err is why the line couldn't be read, for readers that carry on past
+	// such lines, in which case there's no record.
+	err error
+	// seq is the record's place among the data records read, when --order
+	// has them handled in another order.
+	seq int
+}
+
+// isStdio reports whether path names stdin or stdout rather than a file,
+// which it does when it's empty or "-".
+func isStdio(path string) bool {
+	return path == "" || path == "-"
+}
+
+// openInput opens the file at path, or stdin if isStdio(path), decompressing
+// it if gzipped is set or path ends in .gz. Closing it leaves stdin open.
+func openInput(path string, gzipped bool) (io.ReadCloser, error) {
+	var f io.ReadCloser = ioutil.NopCloser(os.Stdin)
+	if !isStdio(path) {
+		var err error
+		if f, err = os.Open(path); err != nil {
+			return nil, err
+		}
+	}
+	if !gzipped && !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+	gzreader, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("decompressing: %w", err)
+	}
+	return gzipInput{gzreader, f}, nil
+}
+
+// gzipInput is a gzipped input, closing the file under it when it's closed.
+type gzipInput struct {
+	*gzip.Reader
+	file io.Closer
+}
+
+func (in gzipInput) Close() error {
+	in.Reader.Close()
+	return in.file.Close()
+}
+
+// skipBOM returns r, buffered, without the byte order mark it starts with if
+// it does, as files saved by Excel and Notepad often do.
+func skipBOM(r io.Reader) *bufio.Reader {
+	buffered := bufio.NewReader(r)
+	if c, _, err := buffered.ReadRune(); err == nil && c != '\uFEFF' {
+		buffered.UnreadRune()
+	}
+	return buffered
+}
+
+// lineCounter passes on what r reads a line at a time, counting the lines, so
+// that once a csv.Reader reading from it has returned a record, the lines it
+// has read through are known.
+type lineCounter struct {
+	r     *bufio.Reader
+	line  []byte
+	err   error
+	lines int
+}
+
+func (c *lineCounter) Read(p []byte) (int, error) {
+	if len(c.line) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		line, err := c.r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			c.err = err
+		}
+		if len(line) == 0 {
+			return 0, c.err
+		}
+		// A line is counted once its end is read, or the end of the input
+		// if it has no line break.
+		if line[len(line)-1] == '\n' || err == io.EOF {
+			c.lines++
+		}
+		c.line = line
+	}
+	n := copy(p, c.line)
+	c.line = c.line[n:]
+	return n, nil
+}
+
+// startLine returns the line that record, which the reader has just returned,
+// started on: as a record only spans several lines by having line breaks in
+// its quoted fields, it's that many lines before the last one read.
+func (c *lineCounter) startLine(record []string) int {
+	line := c.lines
+	for _, field := range record {
+		line -= strings.Count(field, "\n")
+	}
+	return line
+}
+
+// parseInputEncoding returns the character encoding called name, such as
+// windows-1252 or ISO-8859-1, or nil for UTF-8, which needs no decoding.
+func parseInputEncoding(name string) (encoding.Encoding, error) {
+	if name == "" || strings.EqualFold(name, "utf-8") || strings.EqualFold(name, "utf8") {
+		return nil, nil
+	}
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown encoding %q", name)
+	}
+	if enc == nil {
+		return nil, fmt.Errorf("encoding %q isn't supported", name)
+	}
+	return enc, nil
+}
+
+// parseDelimiter returns the field delimiter named by s, which is either a
+// single character or the escape \t for a tab.
+func parseDelimiter(s string) (rune, error) {
+	if s == `\t` {
+		return '\t', nil
+	}
+	r, size := utf8.DecodeRuneInString(s)
+	if size == 0 || size != len(s) {
+		return 0, fmt.Errorf("delimiter %q must be a single character", s)
+	}
+	if r == '"' || r == '\r' || r == '\n' || r == utf8.RuneError {
+		return 0, fmt.Errorf("delimiter %q can't be used", s)
+	}
+	return r, nil
+}
+
+// resolveColumn returns the index of column, which is either a zero-based
+// index or, if there's a header, one of its names. An empty column is -1.
+func resolveColumn(column string, header []string) (int, error) {
+	if column == "" {
+		return -1, nil
+	}
+	if i, err := strconv.Atoi(column); err == nil {
+		if i < 0 {
+			return 0, fmt.Errorf("column %d can't be negative", i)
+		}
+		return i, nil
+	}
+	if header == nil {
+		return 0, fmt.Errorf(
+			"column %q isn't an index; use --header to select columns by name",
+			column)
+	}
+	for i, name := range header {
+		if name == column {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no column named %q in the header", column)
+}
+
+// resolveColumns returns the indexes of the comma-separated columns, each
+// resolved as resolveColumn does, or nil if there are none.
+func resolveColumns(columns string, header []string) ([]int, error) {
+	var indexes []int
+	for _, column := range strings.Split(columns, ",") {
+		if column = strings.TrimSpace(column); column == "" {
+			continue
+		}
+		i, err := resolveColumn(column, header)
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, i)
+	}
+	return indexes, nil
+}
+
+// CSVReadOptions is how ReadCSVFile reads CSV.
+type CSVReadOptions struct {
+	// Gzipped input is decompressed, as is input whose name ends in .gz.
+	Gzipped bool
+	// Encoding, unless it's nil, is what the input is decoded from; otherwise
+	// it must be UTF-8.
+	Encoding encoding.Encoding
+	// Delimiter separates fields.
+	Delimiter rune
+	// Comment, unless it's 0, starts lines that are skipped.
+	Comment rune
+	// AllowBlank skips records with nothing but whitespace in them, rather
+	// than failing them.
+	AllowBlank bool
+	// Ragged pads records with empty fields, or cuts them short, to the first
+	// one's width, rather than failing them.
+	Ragged bool
+	// LazyQuotes lets quotes appear in unquoted fields and unescaped in
+	// quoted ones.
+	LazyQuotes bool
+	// KeepGoing sends a line that can't be read as a record with its err set,
+	// rather than ending the read.
+	KeepGoing bool
+}
+
+// ReadCSVFile reads the CSV file at path, or stdin if isStdio(path), as format
+// says, and sends each of its records to records, closing the channel once the
+// file is exhausted, ctx is done or an error occurs. Every record must be
+// non-empty and have the same number of columns as the first one, unless
+// format allows otherwise. A byte order mark at the start of the file is
+// skipped, and so are records with nothing but whitespace in them at its end.
+func ReadCSVFile(ctx context.Context, path string, format CSVReadOptions, records chan<- CSVRecord) error {
+	defer close(records)
+
+	inputfile, err := openInput(path, format.Gzipped)
+	if err != nil {
+		return err
+	}
+	defer inputfile.Close()
+
+	var input io.Reader = inputfile
+	if format.Encoding != nil {
+		input = format.Encoding.NewDecoder().Reader(inputfile)
+	}
+	lines := &lineCounter{r: skipBOM(input)}
+	csvreader := csv.NewReader(lines)
+	csvreader.Comma = format.Delimiter
+	csvreader.Comment = format.Comment
+	csvreader.LazyQuotes = format.LazyQuotes
+	if format.Ragged {
+		csvreader.FieldsPerRecord = -1
+	}
+
+	send := func(r CSVRecord) error {
+		select {
+		case records <- r:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// Records read ahead, to tell whether blank ones are at the end, are
+	// kept in ahead until they're handled.
+	type readResult struct {
+		record []string
+		lineNo int
+		err    error
+	}
+	var ahead []readResult
+	readAhead := func() readResult {
+		record, err := csvreader.Read()
+		r := readResult{record: record, err: err}
+		if len(record) > 0 {
+			r.lineNo = lines.startLine(record)
+		}
+		return r
+	}
+
+	lineNo := 0
+	numColumns := -1
+	for {
+		lineNo++
+		var next readResult
+		if len(ahead) > 0 {
+			next, ahead = ahead[0], ahead[1:]
+		} else {
+			next = readAhead()
+		}
+		record, err := next.record, next.err
+		var parseErr *csv.ParseError
+		if err == io.EOF {
+			return nil
+		} else if format.KeepGoing && errors.As(err, &parseErr) {
+			// The reader moves on to the next line after a parse error.
+			err = fmt.Errorf("column %d: %w", parseErr.Column, parseErr.Err)
+			if err := send(CSVRecord{lineNo: parseErr.Line, err: err}); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		if len(record) > 0 {
+			// The reader skips empty and comment lines, so the record isn't
+			// necessarily on the line after the last one.
+			lineNo = next.lineNo
+		}
+
+		recordLen := len(record)
+		if format.AllowBlank && isBlankRecord(record) {
+			continue
+		}
+		if recordLen > 0 && isBlankRecord(record) && len(ahead) == 0 {
+			// Spreadsheets often save rows of empty cells at the end of a
+			// sheet, which are dropped rather than failed as blank lines.
+			for {
+				r := readAhead()
+				ahead = append(ahead, r)
+				if r.err == io.EOF {
+					return nil
+				} else if r.err != nil || !isBlankRecord(r.record) {
+					break
+				}
+			}
+		}
+		if recordLen == 0 {
+			return fmt.Errorf("empty record found on line %d", lineNo)
+		}
+
+		// If this is the first line, then set the expected columns. All lines
+		// should have the same number of columns.
+		if numColumns == -1 {
+			numColumns = recordLen
+		} else if format.Ragged && recordLen < numColumns {
+			record = append(record, make([]string, numColumns-recordLen)...)
+		} else if format.Ragged {
+			record = record[:numColumns]
+		} else if numColumns != recordLen {
+			return fmt.Errorf(
+				"expected %d columns but found %d columns on line %d",
+				numColumns,
+				recordLen,
+				lineNo)
+		}
+
+		if err := send(CSVRecord{lineNo: lineNo, record: record, width: recordLen}); err != nil {
+			return err
+		}
+	}
+}
+
+// isBlankRecord reports whether record has nothing but whitespace in it.
+func isBlankRecord(record []string) bool {
+	for _, field := range record {
+		if strings.TrimSpace(field) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// readInputs reads each of paths in turn with read, sending their records to
+// records as if they came from a single input and closing it once they're
+// exhausted, limit records other than the header have been sent, ctx is done
+// or an error occurs. A limit of 0 means no limit, and records with their err
+// set don't count towards it. If header is set, every
+// input after the first must start with the same header as the first, which
+// isn't sent again. With more than one path, each record is marked with the
+// one it came from. A reading error names the file it happened in.
+func readInputs(
+	ctx context.Context,
+	paths []string,
+	header bool,
+	limit int,
+	read func(ctx context.Context, path string, records chan<- CSVRecord) error,
+	records chan<- CSVRecord,
+) error {
+	defer close(records)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var firstHeader []string
+	sent := 0
+	for i, path := range paths {
+		inputRecords := make(chan CSVRecord)
+		readDone := make(chan error, 1)
+		go func(path string) {
+			readDone <- read(ctx, path, inputRecords)
+		}(path)
+		// stop ends the read of this input early.
+		stop := func() {
+			cancel()
+			for range inputRecords {
+			}
+			<-readDone
+		}
+
+		isHeader := header
+		for r := range inputRecords {
+			if r.err == nil && isHeader {
+				isHeader = false
+				if i == 0 {
+					firstHeader = r.record
+				} else if !equalStrings(r.record, firstHeader) {
+					stop()
+					return fmt.Errorf("%s: header doesn't match that of %s", path, paths[0])
+				} else {
+					continue
+				}
+			} else if r.err == nil {
+				sent++
+			}
+			if len(paths) > 1 {
+				r.input = path
+			}
+			select {
+			case records <- r:
+			case <-ctx.Done():
+				stop()
+				return ctx.Err()
+			}
+			if limit > 0 && sent == limit {
+				stop()
+				return nil
+			}
+		}
+		// Errors opening the file already name it.
+		var pathErr *os.PathError
+		if err := <-readDone; err != nil && !isStdio(path) &&
+			!errors.As(err, &pathErr) && !errors.Is(err, context.Canceled) {
+			return fmt.Errorf("%s: %w", path, err)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandInputs returns the paths named by inputs, in order, expanding any
+// that are glob patterns into the files matching them. No inputs means stdin.
+func expandInputs(inputs []string) ([]string, error) {
+	if len(inputs) == 0 {
+		return []string{"-"}, nil
+	}
+	var paths []string
+	for _, input := range inputs {
+		if !strings.ContainsAny(input, "*?[") {
+			paths = append(paths, input)
+			continue
+		}
+		matches, err := filepath.Glob(input)
+		if err != nil {
+			return nil, fmt.Errorf("--input %q: %w", input, err)
+		} else if len(matches) == 0 {
+			return nil, fmt.Errorf("--input %q doesn't match any files", input)
+		}
+		paths = append(paths, matches...)
+	}
+	if len(paths) > 1 {
+		for _, path := range paths {
+			if isStdio(path) {
+				return nil, errors.New("stdin can't be read along with other inputs")
+			}
+		}
+	}
+	return paths, nil
+}
@@ -0,0 +1,102 @@
+package parrot
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// readTestCSV writes contents to a file and reads it with ReadCSVFile,
+// returning the records it sent.
+func readTestCSV(t *testing.T, contents string, comment rune) []CSVRecord {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "input.csv")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	records := make(chan CSVRecord)
+	done := make(chan error, 1)
+	go func() {
+		done <- ReadCSVFile(context.Background(), path, CSVReadOptions{Delimiter: ',', Comment: comment}, records)
+	}()
+	var read []CSVRecord
+	for r := range records {
+		read = append(read, r)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("ReadCSVFile: %v", err)
+	}
+	return read
+}
+
+func TestReadCSVFileLineNumbers(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		comment  rune
+		want     []int
+	}{
+		{
+			name:     "one line each",
+			contents: "a\nb\nc\n",
+			want:     []int{1, 2, 3},
+		},
+		{
+			name:     "no final line break",
+			contents: "a\nb",
+			want:     []int{1, 2},
+		},
+		{
+			name:     "empty lines",
+			contents: "a\n\n\nb\n",
+			want:     []int{1, 4},
+		},
+		{
+			name:     "comments",
+			contents: "# header\na\n# more\n# and more\nb\n",
+			comment:  '#',
+			want:     []int{2, 5},
+		},
+		{
+			name:     "quoted line breaks",
+			contents: "\"a\nb\nc\"\nd\n\"e\r\nf\"\r\ng\r\n",
+			want:     []int{1, 4, 5, 7},
+		},
+		{
+			name:     "byte order mark",
+			contents: "\uFEFFa\nb\n",
+			want:     []int{1, 2},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			records := readTestCSV(t, test.contents, test.comment)
+			if len(records) != len(test.want) {
+				t.Fatalf("got %d records, want %d", len(records), len(test.want))
+			}
+			for i, r := range records {
+				if r.lineNo != test.want[i] {
+					t.Errorf("record %d (%q) is on line %d, want %d", i, r.record, r.lineNo, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReadCSVFileLongLine(t *testing.T) {
+	long := make([]byte, 10000)
+	for i := range long {
+		long[i] = 'x'
+	}
+	records := readTestCSV(t, "a\n"+string(long)+"\nb\n", 0)
+	if len(records) != 3 {
+		t.Fatalf("got %d records, want 3", len(records))
+	}
+	if len(records[1].record[0]) != len(long) {
+		t.Errorf("the long field has %d bytes, want %d", len(records[1].record[0]), len(long))
+	}
+	if records[2].lineNo != 3 {
+		t.Errorf("the last record is on line %d, want 3", records[2].lineNo)
+	}
+}
@@ -0,0 +1,104 @@
+package parrot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// roundTrip reads contents with ReadCSVFile and writes what it read with
+// WriteCSV, both with delimiter, returning what was written.
+func roundTrip(t *testing.T, contents string, delimiter rune, format CSVWriteOptions) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "input.csv")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	records := make(chan CSVRecord)
+	readDone := make(chan error, 1)
+	go func() {
+		readDone <- ReadCSVFile(context.Background(), path, CSVReadOptions{Delimiter: delimiter}, records)
+	}()
+	var written bytes.Buffer
+	format.Delimiter = delimiter
+	writeErr := WriteCSV(&written, format, records)
+	if err := <-readDone; err != nil {
+		t.Fatalf("ReadCSVFile: %v", err)
+	}
+	if writeErr != nil {
+		t.Fatalf("WriteCSV: %v", writeErr)
+	}
+	return written.String()
+}
+
+func TestReadCSVFileWriteCSVRoundTrip(t *testing.T) {
+	// Each CSV is written with {d} for the delimiter, and must come back byte
+	// for byte with each delimiter in turn.
+	tests := []struct {
+		name     string
+		contents string
+		format   CSVWriteOptions
+	}{
+		{
+			name:     "plain",
+			contents: "text{d}audio\nhello{d}a.mp3\ngoodbye{d}b.mp3\n",
+		},
+		{
+			name:     "embedded delimiter",
+			contents: "text{d}audio\n\"one{d} two\"{d}a.mp3\n",
+		},
+		{
+			name:     "embedded quotes",
+			contents: "text{d}audio\n\"she said \"\"hi\"\"\"{d}a.mp3\n",
+		},
+		{
+			name:     "line breaks in fields",
+			contents: "text{d}audio\n\"one\ntwo\"{d}a.mp3\n\"three\n\nfour\"{d}b.mp3\n",
+		},
+		{
+			name:     "unicode",
+			contents: "text{d}audio\nこんにちは{d}a.mp3\nnaïve café 🦜{d}b.mp3\n",
+		},
+		{
+			name:     "empty trailing field",
+			contents: "text{d}audio{d}note\nhello{d}a.mp3{d}\ngoodbye{d}{d}\n",
+		},
+		{
+			name:     "leading space",
+			contents: "text{d}audio\n\" hello\"{d}a.mp3\n",
+		},
+		{
+			name:     "lone empty field",
+			contents: "text\nhello\n\"\"\ngoodbye\n",
+		},
+		{
+			name:     "always quoted",
+			contents: "\"text\"{d}\"audio\"\n\"one\ntwo\"{d}\"\"\n",
+			format:   CSVWriteOptions{AlwaysQuote: true},
+		},
+		{
+			name:     "crlf",
+			contents: "text{d}audio\r\n\"one\r\ntwo\"{d}a.mp3\r\n\"\"\"hi\"\"\"{d}\r\n",
+			format:   CSVWriteOptions{UseCRLF: true},
+		},
+		{
+			name:     "always quoted crlf",
+			contents: "\"text\"{d}\"audio\"\r\n\"one\r\ntwo\"{d}\"a.mp3\"\r\n",
+			format:   CSVWriteOptions{AlwaysQuote: true, UseCRLF: true},
+		},
+	}
+	for _, delimiter := range []rune{',', ';', '\t', '|'} {
+		for _, test := range tests {
+			t.Run(fmt.Sprintf("%s %q", test.name, delimiter), func(t *testing.T) {
+				contents := strings.ReplaceAll(test.contents, "{d}", string(delimiter))
+				if got := roundTrip(t, contents, delimiter, test.format); got != contents {
+					t.Errorf("got\n%q\nwant\n%q", got, contents)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package parrot
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// readCompletedKeys reads the output CSV a previous run left at path, with
+// fields separated by delimiter, returning the values of column in its rows along with how many columns the
+// rows have. A missing file is treated as an empty one, with -1 columns. If
+// compressed is set the file is gzipped, possibly as several streams, one per
+// run that appended to it. It's an error for the file's lines to end in \r\n
+// unless crlf is set, or in \n alone if it is, as appending to it would mix
+// the two.
+func readCompletedKeys(
+	path string,
+	column int,
+	delimiter rune,
+	compressed bool,
+	crlf bool,
+) (map[string]bool, int, error) {
+	keys := make(map[string]bool)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return keys, -1, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if compressed {
+		gzreader, err := gzip.NewReader(f)
+		if err == io.EOF {
+			return keys, -1, nil
+		} else if err != nil {
+			return nil, 0, fmt.Errorf("reading %s to resume: %w", path, err)
+		}
+		defer gzreader.Close()
+		r = gzreader
+	}
+
+	endings := &lineEndings{r: r}
+	reader := csv.NewReader(endings)
+	reader.Comma = delimiter
+	numColumns := -1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			if endings.seen && endings.crlf != crlf {
+				if crlf {
+					return nil, 0, fmt.Errorf(
+						"can't resume: %s ends its lines with \\n, not \\r\\n; leave out --crlf to match it",
+						path)
+				}
+				return nil, 0, fmt.Errorf(
+					"can't resume: %s ends its lines with \\r\\n, not \\n; set --crlf to match it",
+					path)
+			}
+			return keys, numColumns, nil
+		} else if err != nil {
+			return nil, 0, fmt.Errorf("reading %s to resume: %w", path, err)
+		}
+		if column >= len(record) {
+			return nil, 0, fmt.Errorf(
+				"reading %s to resume: column %d doesn't exist",
+				path,
+				column)
+		}
+		numColumns = len(record)
+		keys[record[column]] = true
+	}
+}
+
+// lineEndings notes whether the first line read through it ends with \r\n.
+type lineEndings struct {
+	r    io.Reader
+	seen bool
+	crlf bool
+	prev byte
+}
+
+func (l *lineEndings) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	for i := 0; i < n && !l.seen; i++ {
+		if p[i] == '\n' {
+			l.seen = true
+			l.crlf = l.prev == '\r'
+		}
+		l.prev = p[i]
+	}
+	return n, err
+}
+
+// readEarlierOutputs reads the output CSVs earlier runs left at paths, with
+// fields separated by delimiter, returning each of their rows by its value of
+// column. The first row of each is left out if header is set. A path ending
+// in .gz is read as gzipped. Where rows from several outputs share a value,
+// the last one read is kept.
+func readEarlierOutputs(
+	paths []string,
+	column int,
+	delimiter rune,
+	header bool,
+) (map[string][]string, error) {
+	rows := make(map[string][]string)
+	for _, path := range paths {
+		in, err := openInput(path, false)
+		if err != nil {
+			return nil, err
+		}
+		reader := csv.NewReader(in)
+		reader.Comma = delimiter
+		reader.FieldsPerRecord = -1
+		for first := true; ; first = false {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				in.Close()
+				return nil, fmt.Errorf("reading %s: %w", path, err)
+			}
+			if first && header {
+				continue
+			}
+			if column >= len(record) {
+				in.Close()
+				return nil, fmt.Errorf("reading %s: column %d doesn't exist", path, column)
+			}
+			rows[record[column]] = record
+		}
+		in.Close()
+	}
+	return rows, nil
+}
+
+// rowLocation is where a row was read from: the input, if there was more than
+// one, and the line.
+type rowLocation struct {
+	input  string
+	lineNo int
+}
+
+// readFailedLines reads the error output a previous run left at path, with
+// fields separated by delimiter, returning the line of each row that failed
+// by its location. The rows of an error output from several inputs start with
+// the input.
+func readFailedLines(path string, delimiter rune) (map[rowLocation][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.Comma = delimiter
+	reader.FieldsPerRecord = -1
+	lines := make(map[rowLocation][]string)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return lines, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("reading %s to retry: %w", path, err)
+		}
+		line := record
+		var location rowLocation
+		if len(record) > 3 {
+			location.input, record = record[0], record[1:]
+		}
+		if location.lineNo, err = strconv.Atoi(record[0]); err != nil {
+			return nil, fmt.Errorf(
+				"reading %s to retry: %q isn't a line number",
+				path,
+				record[0])
+		}
+		lines[location] = line
+	}
+}
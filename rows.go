@@ -0,0 +1,822 @@
+package parrot
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// handleRecord decides what to do with an input record: skipping it, writing
+// it out as it is or handing its audio to the workers to fetch.
+func (st *runState) handleRecord(r CSVRecord) error {
+	options := st.options
+	record := r.record
+	// With --text-columns the record ends with the marker that
+	// mergeTextColumns puts its output back together by, which isn't
+	// one of its columns.
+	width := len(record)
+	if len(st.textColumns) > 0 {
+		width--
+	}
+
+	// rowNo counts data rows, leaving out the header and any lines the
+	// reader skipped.
+	if st.textColumn == 0 {
+		st.dataRows++
+		st.fetchParams.stats.addRead()
+	}
+	rowNo := st.dataRows
+	if st.reordering {
+		rowNo = r.seq + 1
+	}
+	if rowNo <= options.Skip {
+		return nil
+	}
+	location := rowLocation{r.input, r.lineNo}
+	if _, ok := st.retryLines[location]; st.retryLines != nil && !ok {
+		return nil
+	}
+
+	if !st.deadline.IsZero() && !st.clock.Now().Before(st.deadline) {
+		st.deadlineReached = true
+	}
+	if st.ceilingReached || st.budgetReached || st.deadlineReached {
+		st.remainingRows++
+		return nil
+	}
+	if st.retriedRows != nil {
+		st.retriedRows[location] = true
+	}
+
+	for _, c := range []int{st.column, st.voiceColumn, st.languageColumn, st.ssmlColumn, st.fallbackColumn, st.namer.column} {
+		if c >= width {
+			return fmt.Errorf(
+				"column %d doesn't exist on line %d, which has %d columns",
+				c,
+				r.lineNo,
+				width)
+		}
+	}
+	if options.AudioColumnPosition > width {
+		return fmt.Errorf(
+			"--audio-column-position %d is past the end of line %d, which has %d columns",
+			options.AudioColumnPosition,
+			r.lineNo,
+			width)
+	}
+
+	t, ok := st.rowText(r)
+	if !ok {
+		return nil
+	}
+	text := t.text
+
+	rowLanguage := options.Language
+	if st.languageColumn >= 0 && record[st.languageColumn] != "" {
+		rowLanguage = record[st.languageColumn]
+	}
+	rowVoices := st.voices
+	if st.voiceColumn >= 0 && record[st.voiceColumn] != "" {
+		rowVoices = []string{record[st.voiceColumn]}
+	}
+	if rowLanguage == "" || rowVoices[0] == "" {
+		st.fetchParams.errChan <- rowError{
+			input:  r.input,
+			lineNo: r.lineNo,
+			text:   text,
+			err:    errors.New("no voice or language given"),
+		}
+		return nil
+	}
+	if st.voiceCatalog != nil &&
+		(st.voiceColumn >= 0 || st.languageColumn >= 0) {
+		checked := rowLanguage
+		if options.AutoLanguage {
+			checked = ""
+		}
+		var err error
+		for _, voice := range rowVoices {
+			if err = st.checkVoice(st.voiceCatalog, voice, checked); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			st.fetchParams.errChan <- rowError{
+				input:  r.input,
+				lineNo: r.lineNo,
+				text:   text,
+				err:    err,
+			}
+			return nil
+		}
+	}
+
+	// Without partitioning every row shares the one output.
+	partitionKey := ""
+	if options.PartitionBy != "" {
+		partitionKey = rowLanguage
+	}
+	part, err := st.partition(partitionKey)
+	if err != nil {
+		return err
+	}
+	if options.Resume && part.resumedColumns >= 0 {
+		if part.resumedColumns != len(record)+st.extraColumns {
+			return fmt.Errorf(
+				"can't resume: output rows have %d columns but line %d would have %d",
+				part.resumedColumns,
+				r.lineNo,
+				len(record)+st.extraColumns)
+		}
+		// The output holds the text as it was read, not normalized.
+		if part.resumed[record[st.column]] {
+			st.log.rowf(logDebug, r.lineNo, "", "skipped: already in the output")
+			st.fetchParams.stats.add(rowSkipped)
+			return nil
+		}
+	}
+	if earlier, ok := st.earlierRows[record[st.column]]; ok {
+		st.log.rowf(logDebug, r.lineNo, "", "skipped: in an earlier output")
+		st.fetchParams.stats.add(rowSkipped)
+		if options.CopyExisting {
+			st.fetchParams.orderer.deliver(
+				st.fetchParams.orderer.reserve(),
+				CSVRecord{lineNo: r.lineNo, record: earlier},
+				part.records)
+		}
+		return nil
+	}
+
+	st.countedRows++
+	// A row with the same text, language and voices as an earlier one is
+	// written with the earlier row's files rather than synthesized again.
+	key := synthesisKey(text, rowLanguage, rowVoices)
+	if firstLineNo, dup := st.seen.Lookup(key, r.lineNo); dup {
+		first := st.occurrences[key]
+		// report adds the row to --dedupe-report.
+		report := func() {
+			if st.dedupeWriter == nil {
+				return
+			}
+			var firstInput string
+			var files []string
+			if first != nil {
+				firstInput, files = first.input, first.files
+			}
+			entry := []string{strconv.Itoa(r.lineNo), strconv.Itoa(firstLineNo)}
+			if len(st.inputs) > 1 {
+				// Line numbers alone don't say which input a row came
+				// from.
+				entry = []string{r.input, entry[0], firstInput, entry[1]}
+			}
+			st.dedupeWriter.Write(append(entry, text, strings.Join(files, ";")))
+		}
+		if options.OnDuplicate == "skip" {
+			st.logDuplicate(r.lineNo, "skipped: duplicate of line %d", firstLineNo)
+			st.fetchParams.stats.add(rowDuplicate)
+			report()
+			return nil
+		}
+		if options.OnDuplicate == "error" {
+			return fmt.Errorf(
+				"duplicate \"%s\" found on line %d, previously on line %d",
+				text,
+				r.lineNo,
+				firstLineNo)
+		}
+		if first.withheld {
+			// A row left out isn't one a retry got to.
+			st.remainingRows++
+			delete(st.retriedRows, location)
+			return nil
+		}
+		st.logDuplicate(r.lineNo, "reusing the files of line %d", firstLineNo)
+		report()
+		part.rows++
+		part.cached++
+		dup := duplicateRow{
+			input:  r.input,
+			lineNo: r.lineNo,
+			seq:    st.fetchParams.orderer.reserve(),
+			text:   text,
+			record: record,
+			output: part.records,
+		}
+		if first.row != nil {
+			first.row.addDuplicate(dup, st.fetchParams)
+		} else {
+			finishDuplicate(dup, first.extra, first.err, st.fetchParams)
+		}
+		return nil
+	}
+	first := &occurrence{input: r.input}
+	st.occurrences[key] = first
+	part.rows++
+
+	// Figure out what the audio filenames and paths should be, one per
+	// voice.
+	nameText := text
+	if options.HashParams && st.namer.hashed() {
+		// With --compare-voices each voice's file is named after it
+		// anyway.
+		voice := ""
+		if len(options.CompareVoices) == 0 {
+			voice = rowVoices[0]
+		}
+		nameText += synthesisParams(
+			voice,
+			st.engine,
+			rowLanguage,
+			st.fileFormat,
+			options.SampleRate)
+	} else {
+		nameText = rowNameText(
+			text,
+			rowLanguage,
+			rowVoices,
+			options.Language,
+			st.voices,
+			options.PartitionBy != "")
+	}
+	audioName, err := st.namer.name(nameText, record, rowNo, part.audioDir)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", r.lineNo, err)
+	}
+	// Shards are taken from the name before it's decorated, so that
+	// they're still spread by its hash.
+	dir := shardDir(audioName, options.ShardDepth)
+	audioName = options.FilenamePrefix + audioName + options.FilenameSuffix
+	if dir != "" {
+		if !options.DryRun && st.store == nil {
+			err := os.MkdirAll(filepath.Join(part.audioDir, dir), 0755)
+			if err != nil {
+				return err
+			}
+		}
+		// The output gives the file's path relative to --audio-out.
+		audioName = path.Join(dir, audioName)
+	}
+
+	out, err := st.rowOutput(r, t, rowLanguage, rowVoices, audioName, part, first)
+	if err != nil {
+		return err
+	}
+	return st.dispatch(r, t, rowVoices, part, first, out)
+}
+
+// rowText is the text of a row, as it's synthesized.
+type rowText struct {
+	text string
+	ssml bool
+	// fallbackText is the text of --fallback-column, for if synthesizing
+	// text fails.
+	fallbackText string
+	fallbackSSML bool
+	// textUsed is "fallback" if text is the row's fallback, since it had no
+	// text of its own, "silence" if it's the silence given to a row with no
+	// text at all, and empty otherwise.
+	textUsed string
+}
+
+// rowText returns the text of r, after applying --text-template, normalizing
+// and the like. If the row can't be synthesized, it's skipped or sent to the
+// workers' errChan as a failure, and rowText returns false.
+func (st *runState) rowText(r CSVRecord) (rowText, bool) {
+	options := st.options
+	record := r.record
+	text := record[st.column]
+	if st.textTmpl != nil {
+		var err error
+		if text, err = st.textTmpl.render(record, st.header); err != nil {
+			st.fetchParams.errChan <- rowError{
+				input:  r.input,
+				lineNo: r.lineNo,
+				text:   record[st.column],
+				err:    err,
+			}
+			return rowText{}, false
+		}
+	}
+	if options.Normalize {
+		text = normalizeText(text, options.NormalizeLowercase)
+	} else if options.TrimKey {
+		text = trimKey(text)
+	}
+	if len(st.substitutions) > 0 {
+		var applied int
+		if text, applied = substitute(text, st.substitutions); applied > 0 {
+			st.log.rowf(logInfo, r.lineNo, "", "substituted: %d patterns matched, giving \"%s\"", applied, text)
+		}
+	}
+	// A row with no text of its own falls back straight away, and one
+	// with text keeps its fallback for if synthesizing the text fails.
+	var fallbackText, textUsed string
+	var fallbackSSML bool
+	if st.fallbackColumn >= 0 {
+		fallbackText = record[st.fallbackColumn]
+		if options.Normalize {
+			fallbackText = normalizeText(fallbackText, options.NormalizeLowercase)
+		} else if options.TrimKey {
+			fallbackText = trimKey(fallbackText)
+		}
+		fallbackText, _ = substitute(fallbackText, st.substitutions)
+		fallbackSSML, _ = rowIsSSML(fallbackText, nil, -1, false, true)
+		if strings.TrimSpace(text) == "" && strings.TrimSpace(fallbackText) != "" {
+			text, fallbackText, textUsed = fallbackText, "", "fallback"
+		}
+	}
+	if strings.TrimSpace(text) == "" && options.WriteEmptyAudioOnEmptyText {
+		st.log.rowf(logInfo, r.lineNo, "", "empty text: giving it %dms of silence", placeholderBreakMs)
+		text, textUsed = withBreak("", placeholderBreakMs), "silence"
+	}
+	if strings.TrimSpace(text) == "" {
+		if options.AllowBlankLines || options.SkipEmptyText {
+			st.log.rowf(logDebug, r.lineNo, "", "skipped: no text")
+			return rowText{}, false
+		}
+		// Polly would only reject it, or return no audio.
+		st.fetchParams.errChan <- rowError{
+			input:  r.input,
+			lineNo: r.lineNo,
+			text:   text,
+			err:    errors.New("empty text"),
+		}
+		return rowText{}, false
+	}
+	ssml, err := rowIsSSML(text, record, st.ssmlColumn, options.SSML, options.DetectSSML)
+	if textUsed == "fallback" {
+		ssml, err = fallbackSSML, nil
+	} else if textUsed == "silence" {
+		ssml, err = true, nil
+	}
+	if err != nil {
+		st.fetchParams.errChan <- rowError{
+			input:  r.input,
+			lineNo: r.lineNo,
+			text:   text,
+			err:    err,
+		}
+		return rowText{}, false
+	}
+	if options.TextPrefix != "" || options.TextSuffix != "" {
+		affixed := options.TextPrefix + text + options.TextSuffix
+		var err error
+		if ssml {
+			affixed, err = insideSpeak(text, options.TextPrefix, options.TextSuffix)
+		}
+		if err != nil {
+			st.fetchParams.errChan <- rowError{
+				input:  r.input,
+				lineNo: r.lineNo,
+				text:   text,
+				err:    err,
+			}
+			return rowText{}, false
+		}
+		text = affixed
+	}
+	if options.TextMaxBytes > 0 && len(text) > options.TextMaxBytes {
+		switch options.TextMaxBytesPolicy {
+		case "skip":
+			st.log.rowf(
+				logNormal,
+				r.lineNo,
+				"",
+				"skipped: text is %d bytes, longer than --text-max-bytes %d",
+				len(text),
+				options.TextMaxBytes)
+			st.fetchParams.stats.add(rowTooLong)
+			return rowText{}, false
+		case "truncate":
+			// Cutting SSML could leave its markup unclosed.
+			if ssml {
+				st.fetchParams.errChan <- rowError{
+					input:  r.input,
+					lineNo: r.lineNo,
+					text:   text,
+					err: fmt.Errorf(
+						"SSML text of %d bytes can't be truncated to --text-max-bytes %d",
+						len(text),
+						options.TextMaxBytes),
+				}
+				return rowText{}, false
+			}
+			truncated := truncateBytes(text, options.TextMaxBytes)
+			st.log.rowf(
+				logNormal,
+				r.lineNo,
+				"",
+				"text truncated from %d to %d bytes",
+				len(text),
+				len(truncated))
+			text = truncated
+		case "split":
+			st.log.rowf(
+				logNormal,
+				r.lineNo,
+				"",
+				"text is %d bytes, longer than --text-max-bytes %d; synthesizing it split as usual",
+				len(text),
+				options.TextMaxBytes)
+		}
+	}
+	return rowText{
+		text:         text,
+		ssml:         ssml,
+		fallbackText: fallbackText,
+		fallbackSSML: fallbackSSML,
+		textUsed:     textUsed,
+	}, true
+}
+
+// rowOutput is what a row that isn't a duplicate adds to the output, and the
+// jobs of fetching its files that don't exist yet.
+type rowOutput struct {
+	record   []string
+	pending  []fetchJob
+	manifest []*manifestEntry
+	// checksumErr is set if an existing file doesn't match its checksum.
+	checksumErr error
+}
+
+// rowOutput works out the files of r, one per voice of rowVoices and named
+// after audioName, and the output row that names them.
+func (st *runState) rowOutput(
+	r CSVRecord,
+	t rowText,
+	rowLanguage string,
+	rowVoices []string,
+	audioName string,
+	part *partition,
+	first *occurrence,
+) (rowOutput, error) {
+	options := st.options
+	record := r.record
+	text, ssml := t.text, t.ssml
+	outputRecord := record
+	if options.EmitCharCount {
+		outputRecord = append(outputRecord, strconv.Itoa(billableChars(text, ssml)))
+	}
+	var pending []fetchJob
+	var rowManifest []*manifestEntry
+	var checksumErr error
+	if options.Async {
+		// The task writes straight to S3, so there's no local file to
+		// check, and the audio's URI is added to the row once the task
+		// has finished.
+		pending = append(pending, fetchJob{
+			text:         text,
+			ssml:         ssml,
+			languageCode: rowLanguage,
+			voice:        rowVoices[0],
+			engine:       st.engine,
+		})
+	} else {
+		// With --voice-engine-fallback the engine isn't known until
+		// the audio is made, so it's left empty for audio that exists.
+		emittedEngine := ""
+		if options.EmitEngine && !options.VoiceEngineFallback {
+			emittedEngine = st.engine
+		}
+		for _, voice := range rowVoices {
+			baseFilename := audioName
+			if len(options.CompareVoices) > 0 {
+				baseFilename = audioName + "." + voice
+			}
+			job := fetchJob{
+				text:         text,
+				ssml:         ssml,
+				fallbackText: t.fallbackText,
+				fallbackSSML: t.fallbackSSML,
+				languageCode: rowLanguage,
+				voice:        voice,
+				engine:       st.engine,
+			}
+
+			audioFilename := baseFilename + st.audioExt
+			first.files = append(first.files, audioFilename)
+			if st.store != nil {
+				audioKey := path.Join(part.audioDir, audioFilename)
+				outputRecord = append(outputRecord, st.store.uri(audioKey))
+				if options.RequestIDs {
+					job.requestIDColumn = len(outputRecord)
+					outputRecord = append(outputRecord, "")
+				}
+				if options.EmitVoice {
+					outputRecord = append(outputRecord, voice)
+				}
+				if options.VoiceEngineFallback || options.EmitEngine {
+					job.engineColumn = len(outputRecord)
+					outputRecord = append(outputRecord, emittedEngine)
+				}
+				if st.fallbackColumn >= 0 {
+					job.textUsedColumn = len(outputRecord)
+					outputRecord = append(outputRecord, t.textUsed)
+				}
+				if missing, err := st.store.missing(st.ctx, audioKey); err != nil {
+					return rowOutput{}, err
+				} else if missing || options.Force {
+					job.audioKey = audioKey
+					pending = append(pending, job)
+				} else {
+					st.cachedFiles++
+				}
+				continue
+			}
+			if options.ContentTypeExtension {
+				ext, err := foundAudioExt(part.audioDir, baseFilename, st.audioExt)
+				if err != nil {
+					return rowOutput{}, err
+				}
+				audioFilename = baseFilename + ext
+			}
+			job.audioColumn = len(outputRecord)
+			outputRecord = append(outputRecord, audioFilename)
+			audioFilepath := filepath.Join(part.audioDir, audioFilename)
+			if options.Manifest != "" || options.Playlist != "" {
+				job.manifest = &manifestEntry{
+					Text:     text,
+					Voice:    voice,
+					Engine:   st.engine,
+					Language: rowLanguage,
+					File:     audioFilename,
+					path:     audioFilepath,
+				}
+				rowManifest = append(rowManifest, job.manifest)
+			}
+			if missing, err := audioMissing(
+				audioFilepath,
+				st.fileFormat,
+				options.VerifyAudio); err != nil {
+				return rowOutput{}, err
+			} else if missing || options.Force {
+				job.audioFilepath = audioFilepath
+				metaFilepath := filepath.Join(part.audioDir, baseFilename+".meta.json")
+				if options.ChecksumVerify && !options.WriteMeta {
+					// An existing meta file is brought up to date, so
+					// that the new file isn't checked against the old
+					// file's checksum.
+					if missing, err := fileMissing(metaFilepath); err != nil {
+						return rowOutput{}, err
+					} else if !missing {
+						job.metaFilepath = metaFilepath
+						job.sizeColumn = -1
+					}
+				}
+				if options.ChunkBoundaries {
+					job.chunksFilepath = filepath.Join(
+						part.audioDir,
+						baseFilename+".chunks.json")
+				}
+				if options.WriteSourceText {
+					job.sourceFilepath = filepath.Join(part.audioDir, baseFilename+".txt")
+				}
+			} else {
+				st.cachedFiles++
+				if options.ChecksumVerify && checksumErr == nil {
+					ok, err := checkAudioChecksum(
+						audioFilepath,
+						filepath.Join(part.audioDir, baseFilename+".meta.json"))
+					if err != nil {
+						return rowOutput{}, err
+					} else if !ok {
+						checksumErr = fmt.Errorf(
+							"%s doesn't match the checksum in its meta file",
+							audioFilename)
+					}
+				}
+			}
+
+			if options.WriteMeta {
+				metaFilepath := filepath.Join(part.audioDir, baseFilename+".meta.json")
+				size := ""
+				if job.audioFilepath != "" {
+					job.metaFilepath = metaFilepath
+					job.sizeColumn = len(outputRecord)
+				} else if !options.DryRun {
+					audioBytes, err := cachedAudioSize(
+						audioFilepath,
+						metaFilepath,
+						options.Format)
+					if err != nil {
+						return rowOutput{}, err
+					}
+					size = strconv.FormatInt(audioBytes, 10)
+				}
+				outputRecord = append(outputRecord, size)
+			}
+			if options.RequestIDs {
+				job.requestIDColumn = len(outputRecord)
+				outputRecord = append(outputRecord, "")
+			}
+			if options.EmitVoice {
+				outputRecord = append(outputRecord, voice)
+			}
+			if options.VoiceEngineFallback || options.EmitEngine {
+				job.engineColumn = len(outputRecord)
+				outputRecord = append(outputRecord, emittedEngine)
+			}
+			if st.fallbackColumn >= 0 {
+				job.textUsedColumn = len(outputRecord)
+				outputRecord = append(outputRecord, t.textUsed)
+			}
+
+			if len(st.speechMarkTypes) > 0 {
+				marksFilename := baseFilename + ".marks.json"
+				outputRecord = append(outputRecord, marksFilename)
+				marksFilepath := filepath.Join(part.audioDir, marksFilename)
+				if missing, err := fileMissing(marksFilepath); err != nil {
+					return rowOutput{}, err
+				} else if missing || options.Force {
+					job.marksFilepath = marksFilepath
+				}
+			}
+
+			if options.Subtitles != "" {
+				subtitlesFilename := baseFilename + "." + options.Subtitles
+				outputRecord = append(outputRecord, subtitlesFilename)
+				subtitlesFilepath := filepath.Join(part.audioDir, subtitlesFilename)
+				if missing, err := fileMissing(subtitlesFilepath); err != nil {
+					return rowOutput{}, err
+				} else if missing || options.Force {
+					job.subtitlesFilepath = subtitlesFilepath
+				}
+			}
+
+			if job.audioFilepath != "" ||
+				job.marksFilepath != "" ||
+				job.subtitlesFilepath != "" {
+				pending = append(pending, job)
+			}
+		}
+	}
+	return rowOutput{
+		record:      outputRecord,
+		pending:     pending,
+		manifest:    rowManifest,
+		checksumErr: checksumErr,
+	}, nil
+}
+
+// dispatch writes r out straight away if all of its files exist, and
+// otherwise hands those that don't to the workers to fetch, unless the run is
+// a dry run or would go past a limit by doing so.
+func (st *runState) dispatch(
+	r CSVRecord,
+	t rowText,
+	rowVoices []string,
+	part *partition,
+	first *occurrence,
+	out rowOutput,
+) error {
+	options := st.options
+	record := r.record
+	text, ssml := t.text, t.ssml
+	outputRecord, pending, rowManifest, checksumErr := out.record, out.pending, out.manifest, out.checksumErr
+	if checksumErr != nil {
+		first.err = checksumErr
+		st.fetchParams.errChan <- rowError{
+			input:  r.input,
+			lineNo: r.lineNo,
+			text:   text,
+			err:    checksumErr,
+		}
+		return nil
+	}
+
+	if len(pending) == 0 {
+		// Every file exists. Just write the output and we're done.
+		for _, voice := range rowVoices {
+			st.log.rowf(logDebug, r.lineNo, voice, "cached")
+		}
+		part.cached++
+		st.existingTexts++
+		st.fetchParams.stats.add(rowCached)
+		first.extra = outputRecord[len(record):]
+		st.manifest = append(st.manifest, rowManifest...)
+		st.fetchParams.orderer.deliver(
+			st.fetchParams.orderer.reserve(),
+			CSVRecord{lineNo: r.lineNo, record: outputRecord},
+			part.records)
+		return nil
+	}
+
+	if options.CostCeiling > 0 {
+		spent := st.fetchParams.costs.cost()
+		estimate := st.fetchParams.costs.estimate(text, ssml) * float64(len(pending))
+		if spent+st.unbilledEstimate+estimate > options.CostCeiling {
+			// This row could take spending past the ceiling, so let
+			// in-flight requests report their actual cost before
+			// deciding on it.
+			st.fetchParams.waitGroup.Wait()
+			st.unbilledEstimate = 0
+			spent = st.fetchParams.costs.cost()
+		}
+		if spent+estimate > options.CostCeiling {
+			st.ceilingReached = true
+			st.remainingRows++
+			delete(st.retriedRows, rowLocation{r.input, r.lineNo})
+			first.withheld = true
+			return nil
+		}
+		st.unbilledEstimate += estimate
+	}
+
+	if options.MaxTotalChars > 0 {
+		chars := billableChars(text, ssml) * len(pending)
+		if st.dispatchedChars+chars > options.MaxTotalChars {
+			st.budgetReached = true
+			st.remainingRows++
+			delete(st.retriedRows, rowLocation{r.input, r.lineNo})
+			first.withheld = true
+			return nil
+		}
+		st.dispatchedChars += chars
+	}
+
+	if options.DryRun {
+		// Count what would be fetched instead of fetching it.
+		part.synthesized++
+		st.newTexts++
+		for _, job := range pending {
+			if job.audioFilepath != "" || job.audioKey != "" || options.Async {
+				st.newFiles++
+			}
+			st.newChars += billableChars(text, ssml)
+		}
+		if options.Async {
+			// There's no S3 URI until the task has run.
+			outputRecord = append(outputRecord, "")
+		}
+		first.extra = outputRecord[len(record):]
+		st.fetchParams.orderer.deliver(
+			st.fetchParams.orderer.reserve(),
+			CSVRecord{lineNo: r.lineNo, record: outputRecord},
+			part.records)
+		return nil
+	}
+
+	if st.minFreeDisk > 0 {
+		// Stopping here, rather than when a write fails, leaves the
+		// output and the audio files already written intact.
+		free, err := freeDiskSpace(options.AudioOut)
+		if err != nil {
+			return fmt.Errorf("checking free space on %s: %w", options.AudioOut, err)
+		}
+		if free < st.minFreeDisk {
+			return fmt.Errorf(
+				"line %d: only %d bytes free on %s, less than --min-free-disk %s",
+				r.lineNo,
+				free,
+				options.AudioOut,
+				options.MinFreeDisk)
+		}
+	}
+
+	// Hand the missing files to the workers to fetch. The row is
+	// written once they all have been.
+	part.synthesized++
+	row := &pendingRow{
+		input:        r.input,
+		lineNo:       r.lineNo,
+		seq:          st.fetchParams.orderer.reserve(),
+		text:         text,
+		output:       part.records,
+		inputColumns: len(record),
+		record:       outputRecord,
+		remaining:    len(pending),
+	}
+	first.row = row
+	for _, entry := range rowManifest {
+		entry.row = row
+	}
+	st.manifest = append(st.manifest, rowManifest...)
+	st.fetchParams.stats.addInFlight(1)
+	for _, job := range pending {
+		job.row = row
+		st.fetchParams.waitGroup.Add(1)
+		st.fetchParams.jobs <- job
+	}
+	if options.Preview {
+		// With --text-columns each of the row's columns is previewed.
+		st.previewed, st.previewLine = append(st.previewed, pending...), r.lineNo
+	}
+	if options.Sequential {
+		st.fetchParams.waitGroup.Wait()
+	}
+	return nil
+}
+
+// logDuplicate logs a row skipped or reused as a duplicate, unless
+// --max-duplicate-log have been already.
+func (st *runState) logDuplicate(lineNo int, format string, args ...interface{}) {
+	options := st.options
+	st.duplicatesNoticed++
+	if options.MaxDuplicateLog == 0 || st.duplicatesNoticed <= options.MaxDuplicateLog {
+		st.log.rowf(logDebug, lineNo, "", format, args...)
+	}
+}
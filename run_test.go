@@ -0,0 +1,263 @@
+package parrot
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/polly"
+	"github.com/aws/smithy-go"
+)
+
+// testRunConfig returns the configuration of a run that reads input from dir
+// and writes its output and audio there, calling client.
+func testRunConfig(dir string, client Synthesizer) Config {
+	options := DefaultConfig()
+	options.Input = []string{filepath.Join(dir, "input.csv")}
+	options.Output = filepath.Join(dir, "output.csv")
+	options.AudioOut = filepath.Join(dir, "audio")
+	options.Mkdir = true
+	options.Voice = "Joanna"
+	options.Language = "en-US"
+	options.Polly = client
+	return options
+}
+
+// audioName returns the name of text's audio file with --naming sha1.
+func audioName(text string) string {
+	return fmt.Sprintf("%x.mp3", sha1.Sum([]byte(text)))
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	input := "hello\ngoodbye\nhello\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "input.csv"), []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wantOutput := fmt.Sprintf(
+		"hello,%s\ngoodbye,%s\nhello,%s\n",
+		audioName("hello"),
+		audioName("goodbye"),
+		audioName("hello"))
+	wantFiles := []string{audioName("goodbye"), audioName("hello")}
+	sort.Strings(wantFiles)
+
+	// check checks the output and audio files a run left in dir.
+	check := func(t *testing.T) {
+		t.Helper()
+		output, err := ioutil.ReadFile(filepath.Join(dir, "output.csv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(output) != wantOutput {
+			t.Errorf("output is\n%s\nwant\n%s", output, wantOutput)
+		}
+		entries, err := ioutil.ReadDir(filepath.Join(dir, "audio"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []string
+		for _, entry := range entries {
+			files = append(files, entry.Name())
+		}
+		if fmt.Sprint(files) != fmt.Sprint(wantFiles) {
+			t.Fatalf("audio files are %v, want %v", files, wantFiles)
+		}
+		for _, text := range []string{"hello", "goodbye"} {
+			audio, err := ioutil.ReadFile(filepath.Join(dir, "audio", audioName(text)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "audio:" + text; string(audio) != want {
+				t.Errorf("%s's audio is %q, want %q", text, audio, want)
+			}
+		}
+	}
+
+	fake := &fakeSynthesizer{}
+	result, err := Run(context.Background(), testRunConfig(dir, fake))
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(result.Failures) > 0 {
+		t.Fatalf("Run failed rows: %v", result.Failures)
+	}
+	// The second hello reuses the first one's audio.
+	if result.Synthesized != 2 {
+		t.Errorf("Run synthesized %d rows, want 2", result.Synthesized)
+	}
+	if requests := len(fake.requests()); requests != 2 {
+		t.Errorf("Run made %d requests, want 2", requests)
+	}
+	check(t)
+
+	// Running again finds the audio already there and synthesizes nothing.
+	rerun := &fakeSynthesizer{}
+	options := testRunConfig(dir, rerun)
+	options.OverwriteOutput = true
+	result, err = Run(context.Background(), options)
+	if err != nil {
+		t.Fatalf("second Run: %v", err)
+	}
+	if result.Synthesized != 0 || result.Cached != 3 {
+		t.Errorf("second Run synthesized %d rows and found %d cached, want 0 and 3", result.Synthesized, result.Cached)
+	}
+	if requests := len(rerun.requests()); requests != 0 {
+		t.Errorf("second Run made %d requests, want 0", requests)
+	}
+	check(t)
+}
+
+func TestRunFailedRows(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "input.csv"), []byte("hello\nbad\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeSynthesizer{fail: func(input *polly.SynthesizeSpeechInput) error {
+		if aws.ToString(input.Text) == "bad" {
+			return &smithy.GenericAPIError{Code: "InvalidSsmlException", Message: "bad text"}
+		}
+		return nil
+	}}
+	result, err := Run(context.Background(), testRunConfig(dir, fake))
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if result.Synthesized != 1 || len(result.Failures) != 1 {
+		t.Errorf("Run synthesized %d rows and failed %d, want 1 and 1", result.Synthesized, len(result.Failures))
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(dir, "audio", audioName("bad"))); err == nil {
+		t.Error("the failed row has an audio file")
+	}
+	output, err := ioutil.ReadFile(filepath.Join(dir, "output.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "hello," + audioName("hello") + "\n"; string(output) != want {
+		t.Errorf("output is %q, want %q", output, want)
+	}
+}
+
+func TestRunDryRunNeedsNoAWS(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "input.csv"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Without a Polly client or a region, any call to AWS would fail.
+	options := testRunConfig(dir, nil)
+	options.Region = ""
+	options.DryRun = true
+	if _, err := Run(context.Background(), options); err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	options.DryRun = false
+	options.CountOnly = true
+	result, err := Run(context.Background(), options)
+	if err != nil {
+		t.Fatalf("--count-only: %v", err)
+	}
+	if result.Rows != 1 || result.NewTexts != 1 {
+		t.Errorf("--count-only found %d rows and %d new texts, want 1 and 1", result.Rows, result.NewTexts)
+	}
+}
+
+func TestRunRetryFailedKeepsUnfinishedRows(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "input.csv"), []byte("one\ntwo\nthree\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	errorsPath := filepath.Join(dir, "errors.csv")
+	failed := "1,one,boom\n2,two,boom\n3,three,boom\n"
+	if err := ioutil.WriteFile(errorsPath, []byte(failed), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// --max-total-chars stops the retry after the first row, so the other
+	// two are left in the file to be retried.
+	options := testRunConfig(dir, &fakeSynthesizer{})
+	options.RetryFailed = errorsPath
+	options.MaxTotalChars = len("one")
+	if _, err := Run(context.Background(), options); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	left, err := ioutil.ReadFile(errorsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2,two,boom\n3,three,boom\n"; string(left) != want {
+		t.Errorf("errors left are %q, want %q", left, want)
+	}
+
+	// Retrying the rest leaves only the row that fails again.
+	fake := &fakeSynthesizer{fail: func(input *polly.SynthesizeSpeechInput) error {
+		if aws.ToString(input.Text) == "three" {
+			return &smithy.GenericAPIError{Code: "InvalidSsmlException", Message: "bad text"}
+		}
+		return nil
+	}}
+	options = testRunConfig(dir, fake)
+	options.RetryFailed = errorsPath
+	if _, err := Run(context.Background(), options); err != nil {
+		t.Fatalf("second Run: %v", err)
+	}
+	if left, err = ioutil.ReadFile(errorsPath); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSuffix(string(left), "\n"), "\n"); len(lines) != 1 || !strings.HasPrefix(lines[0], "3,three,") {
+		t.Errorf("errors left are %q, want only line 3's", left)
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, ".errors.csv.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) > 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+	output, err := ioutil.ReadFile(filepath.Join(dir, "output.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "one," + audioName("one") + "\ntwo," + audioName("two") + "\n"; string(output) != want {
+		t.Errorf("output is %q, want %q", output, want)
+	}
+}
+
+func TestRunRetryFailedFailFastKeepsEveryRow(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "input.csv"), []byte("one\ntwo\nthree\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	errorsPath := filepath.Join(dir, "errors.csv")
+	if err := ioutil.WriteFile(errorsPath, []byte("1,one,boom\n2,two,boom\n3,three,boom\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Every row fails again, and the first failure stops the run, so each
+	// row is either failed again or never finished.
+	fake := &fakeSynthesizer{fail: func(input *polly.SynthesizeSpeechInput) error {
+		return &smithy.GenericAPIError{Code: "InvalidSsmlException", Message: "bad text"}
+	}}
+	options := testRunConfig(dir, fake)
+	options.RetryFailed = errorsPath
+	options.FailFast = true
+	if _, err := Run(context.Background(), options); err == nil {
+		t.Fatal("Run succeeded, want --fail-fast to stop it")
+	}
+	left, err := ioutil.ReadFile(errorsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lineNos []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(left), "\n"), "\n") {
+		lineNos = append(lineNos, strings.SplitN(line, ",", 2)[0])
+	}
+	sort.Strings(lineNos)
+	if fmt.Sprint(lineNos) != "[1 2 3]" {
+		t.Errorf("errors left are %q, want lines 1, 2 and 3", left)
+	}
+}
@@ -0,0 +1,153 @@
+package parrot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/polly/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// formatContentTypes maps each supported Polly output format to the content
+// type its audio is uploaded to S3 with.
+var formatContentTypes = map[string]string{
+	string(types.OutputFormatMp3):       "audio/mpeg",
+	string(types.OutputFormatOggVorbis): "audio/ogg",
+	string(types.OutputFormatPcm):       "audio/pcm",
+}
+
+// audioStore keeps audio files in an S3 bucket, for --audio-s3.
+type audioStore struct {
+	client   *s3.Client
+	uploader *manager.Uploader
+	bucket   string
+	// existing, once listExisting has been called, holds whether each object
+	// listed under listedPrefix is non-empty.
+	existing     map[string]bool
+	listedPrefix string
+}
+
+// parseS3URI splits an s3://bucket/prefix URI into its bucket and key prefix,
+// which may be empty.
+func parseS3URI(uri string) (bucket string, prefix string, err error) {
+	rest := strings.TrimPrefix(uri, "s3://")
+	if rest == uri {
+		return "", "", fmt.Errorf("%q isn't an s3:// URI", uri)
+	}
+	bucket = rest
+	if i := strings.Index(rest, "/"); i >= 0 {
+		bucket, prefix = rest[:i], strings.Trim(rest[i+1:], "/")
+	}
+	if bucket == "" {
+		return "", "", fmt.Errorf("%q doesn't name a bucket", uri)
+	}
+	return bucket, prefix, nil
+}
+
+// newAudioStore returns an audioStore for bucket. Path-style addressing is
+// needed by most services standing in for S3 at a custom endpoint.
+func newAudioStore(cfg aws.Config, bucket string, pathStyle bool) *audioStore {
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = pathStyle
+	})
+	return &audioStore{
+		client:   client,
+		uploader: manager.NewUploader(client),
+		bucket:   bucket,
+	}
+}
+
+// uri returns the s3:// URI of the object at key.
+func (s *audioStore) uri(key string) string {
+	return "s3://" + s.bucket + "/" + key
+}
+
+// listExisting lists the objects under prefix, which may be empty, so that
+// missing can answer for keys under it without a request each.
+func (s *audioStore) listExisting(ctx context.Context, prefix string) error {
+	if prefix != "" {
+		prefix += "/"
+	}
+	existing := make(map[string]bool)
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("listing s3://%s/%s: %w", s.bucket, prefix, err)
+		}
+		for _, obj := range page.Contents {
+			existing[aws.ToString(obj.Key)] = obj.Size > 0
+		}
+	}
+	s.existing = existing
+	s.listedPrefix = prefix
+	return nil
+}
+
+// missing reports whether there's no object at key, or only an empty one.
+func (s *audioStore) missing(ctx context.Context, key string) (bool, error) {
+	if s.existing != nil && strings.HasPrefix(key, s.listedPrefix) {
+		// An object that was empty when listed may have been written since,
+		// so only those are checked again.
+		if nonEmpty, ok := s.existing[key]; !ok {
+			return true, nil
+		} else if nonEmpty {
+			return false, nil
+		}
+	}
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	var respErr *smithyhttp.ResponseError
+	if errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotFound {
+		return true, nil
+	} else if err != nil {
+		return false, fmt.Errorf("checking %s: %w", s.uri(key), err)
+	}
+	return out.ContentLength == 0, nil
+}
+
+// upload streams what write writes to the object at key. If write fails the
+// upload is abandoned, leaving any existing object as it was, and write's
+// error is returned.
+func (s *audioStore) upload(
+	ctx context.Context,
+	key string,
+	contentType string,
+	write func(w io.Writer) error,
+) error {
+	pr, pw := io.Pipe()
+	writeDone := make(chan error, 1)
+	go func() {
+		err := write(pw)
+		pw.CloseWithError(err)
+		writeDone <- err
+	}()
+	_, err := s.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        pr,
+		ContentType: aws.String(contentType),
+	})
+	// Unblock write if the upload stopped reading before it was done.
+	pr.Close()
+	if writeErr := <-writeDone; writeErr != nil &&
+		!errors.Is(writeErr, io.ErrClosedPipe) {
+		return writeErr
+	}
+	if err != nil {
+		return fmt.Errorf("uploading %s: %w", s.uri(key), err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package parrot
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrTrackerStopped is returned by SeenTracker's Check once Stop has been
+// called.
+var ErrTrackerStopped = errors.New("seen tracker stopped")
+
+// SeenTracker remembers the line each key was first seen on so duplicates can
+// be reported. Its map is owned by a single goroutine, so Check and Lookup are
+// safe to call from anywhere between Start and Stop.
+type SeenTracker struct {
+	seen        map[string]int
+	requestChan chan seenRequest
+	// done is closed once the goroutine started by Start has returned.
+	done chan struct{}
+	// mu is held for reading by each request, so that Stop waits for those
+	// in flight before closing requestChan.
+	mu      sync.RWMutex
+	started bool
+	stopped bool
+}
+
+type seenRequest struct {
+	key    string
+	lineNo int
+	// reply receives the line key was first seen on, or 0 if it's new.
+	reply chan int
+}
+
+func NewSeenTracker() *SeenTracker {
+	return &SeenTracker{
+		seen:        make(map[string]int),
+		requestChan: make(chan seenRequest),
+		done:        make(chan struct{}),
+	}
+}
+
+// Start launches the goroutine that answers Check and Lookup. It does nothing
+// if the tracker has already been started or stopped.
+func (t *SeenTracker) Start() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.started || t.stopped {
+		return
+	}
+	t.started = true
+	go func() {
+		defer close(t.done)
+		for req := range t.requestChan {
+			if firstLineNo, ok := t.seen[req.key]; ok {
+				req.reply <- firstLineNo
+			} else {
+				t.seen[req.key] = req.lineNo
+				req.reply <- 0
+			}
+		}
+	}()
+}
+
+// Stop ends the goroutine started by Start, waiting for requests already made
+// to be answered and for the goroutine to return. The tracker can't be used
+// after, and stopping it again does nothing.
+func (t *SeenTracker) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return
+	}
+	t.stopped = true
+	close(t.requestChan)
+	if t.started {
+		<-t.done
+	}
+}
+
+// Check records that key was seen on lineNo, returning an error if it had
+// already been seen on an earlier line, or ErrTrackerStopped if the tracker
+// has been stopped.
+func (t *SeenTracker) Check(key string, lineNo int) error {
+	firstLineNo, err := t.lookup(key, lineNo)
+	if err != nil {
+		return err
+	}
+	if firstLineNo != 0 {
+		return fmt.Errorf(
+			"duplicate \"%s\" found on line %d, previously on line %d",
+			key,
+			lineNo,
+			firstLineNo)
+	}
+	return nil
+}
+
+// Lookup records that key was seen on lineNo. If it had already been seen,
+// dup is true and firstSeen is the line it was first seen on. Unlike Check,
+// it panics if the tracker isn't running.
+func (t *SeenTracker) Lookup(key string, lineNo int) (firstSeen int, dup bool) {
+	firstSeen, err := t.lookup(key, lineNo)
+	if err != nil {
+		panic("parrot: SeenTracker.Lookup: " + err.Error())
+	}
+	return firstSeen, firstSeen != 0
+}
+
+// lookup asks the tracker's goroutine for the line key was first seen on,
+// recording lineNo if it's new.
+func (t *SeenTracker) lookup(key string, lineNo int) (int, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.stopped {
+		return 0, ErrTrackerStopped
+	}
+	if !t.started {
+		return 0, errors.New("seen tracker not started")
+	}
+	reply := make(chan int)
+	t.requestChan <- seenRequest{key: key, lineNo: lineNo, reply: reply}
+	return <-reply, nil
+}
@@ -0,0 +1,88 @@
+package parrot
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestSeenTrackerCheck(t *testing.T) {
+	tracker := NewSeenTracker()
+	tracker.Start()
+	defer tracker.Stop()
+
+	if err := tracker.Check("a", 1); err != nil {
+		t.Fatalf("first a: %v", err)
+	}
+	if err := tracker.Check("b", 2); err != nil {
+		t.Fatalf("first b: %v", err)
+	}
+	if err := tracker.Check("a", 3); err == nil {
+		t.Error("second a: got no error, want a duplicate")
+	}
+	if firstSeen, dup := tracker.Lookup("b", 4); !dup || firstSeen != 2 {
+		t.Errorf("Lookup(b) = %d, %t, want 2, true", firstSeen, dup)
+	}
+	if firstSeen, dup := tracker.Lookup("c", 5); dup || firstSeen != 0 {
+		t.Errorf("Lookup(c) = %d, %t, want 0, false", firstSeen, dup)
+	}
+}
+
+func TestSeenTrackerStopEndsGoroutine(t *testing.T) {
+	before := runtime.NumGoroutine()
+	trackers := make([]*SeenTracker, 10)
+	for i := range trackers {
+		trackers[i] = NewSeenTracker()
+		trackers[i].Start()
+	}
+	if got := runtime.NumGoroutine(); got < before+len(trackers) {
+		t.Fatalf("%d goroutines after starting %d trackers, want at least %d", got, len(trackers), before+len(trackers))
+	}
+	for _, tracker := range trackers {
+		tracker.Stop()
+	}
+	// Stop waits for the goroutine to return, but the runtime may take a
+	// moment to stop counting it.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := runtime.NumGoroutine(); got > before {
+		t.Errorf("%d goroutines after stopping the trackers, want %d", got, before)
+	}
+}
+
+func TestSeenTrackerStopTwice(t *testing.T) {
+	tracker := NewSeenTracker()
+	tracker.Start()
+	tracker.Stop()
+	tracker.Stop()
+
+	unstarted := NewSeenTracker()
+	unstarted.Stop()
+	unstarted.Stop()
+}
+
+func TestSeenTrackerCheckAfterStop(t *testing.T) {
+	tracker := NewSeenTracker()
+	tracker.Start()
+	if err := tracker.Check("a", 1); err != nil {
+		t.Fatal(err)
+	}
+	tracker.Stop()
+	if err := tracker.Check("a", 2); err != ErrTrackerStopped {
+		t.Errorf("Check after Stop = %v, want ErrTrackerStopped", err)
+	}
+	// Starting a stopped tracker doesn't bring it back.
+	tracker.Start()
+	if err := tracker.Check("b", 3); err != ErrTrackerStopped {
+		t.Errorf("Check after Stop and Start = %v, want ErrTrackerStopped", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Lookup after Stop didn't panic")
+		}
+	}()
+	tracker.Lookup("a", 4)
+}
@@ -0,0 +1,153 @@
+package parrot
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// pollyMaxChars is the most billable characters SynthesizeSpeech accepts in a
+// single request.
+const pollyMaxChars = 3000
+
+// splitText splits text into chunks of at most maxChars characters each. The
+// sentence strategy prefers to break between sentences, then between words,
+// and only cuts a word in two if it is longer than maxChars on its own. The
+// paragraph strategy only breaks between paragraphs, separated by blank
+// lines, splitting those that are too long by sentence. The char strategy
+// cuts text every maxChars characters regardless. Except with char, joining
+// the chunks with spaces reads the same as the original text.
+func splitText(text string, maxChars int, strategy string) []string {
+	if utf8.RuneCountInString(text) <= maxChars {
+		return []string{text}
+	}
+	if strategy == "char" {
+		var chunks []string
+		runes := []rune(text)
+		for len(runes) > maxChars {
+			chunks = append(chunks, string(runes[:maxChars]))
+			runes = runes[maxChars:]
+		}
+		return append(chunks, string(runes))
+	}
+
+	var chunks []string
+	var current strings.Builder
+	currentLen := 0
+	flush := func() {
+		if currentLen > 0 {
+			chunks = append(chunks, current.String())
+			current.Reset()
+			currentLen = 0
+		}
+	}
+	// add appends piece to the current chunk, starting a new chunk first if
+	// it wouldn't fit.
+	add := func(piece string) {
+		pieceLen := utf8.RuneCountInString(piece)
+		if currentLen > 0 && currentLen+1+pieceLen > maxChars {
+			flush()
+		}
+		if currentLen > 0 {
+			current.WriteByte(' ')
+			currentLen++
+		}
+		current.WriteString(piece)
+		currentLen += pieceLen
+	}
+
+	// addSentences adds text a sentence at a time, cutting up any that
+	// don't fit in a chunk of their own.
+	addSentences := func(text string) {
+		for _, sentence := range splitSentences(text) {
+			if utf8.RuneCountInString(sentence) <= maxChars {
+				add(sentence)
+				continue
+			}
+			for _, word := range strings.Fields(sentence) {
+				for utf8.RuneCountInString(word) > maxChars {
+					flush()
+					runes := []rune(word)
+					chunks = append(chunks, string(runes[:maxChars]))
+					word = string(runes[maxChars:])
+				}
+				add(word)
+			}
+		}
+	}
+
+	if strategy != "paragraph" {
+		addSentences(text)
+		flush()
+		return chunks
+	}
+	for _, paragraph := range splitParagraphs(text) {
+		if utf8.RuneCountInString(paragraph) <= maxChars {
+			add(paragraph)
+			continue
+		}
+		// A paragraph too long for one chunk still starts and ends one.
+		flush()
+		addSentences(paragraph)
+		flush()
+	}
+	flush()
+	return chunks
+}
+
+// splitParagraphs splits text at each blank line, trimming the whitespace
+// around each paragraph.
+func splitParagraphs(text string) []string {
+	var paragraphs []string
+	var current []string
+	flush := func() {
+		if s := strings.TrimSpace(strings.Join(current, "\n")); s != "" {
+			paragraphs = append(paragraphs, s)
+		}
+		current = nil
+	}
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			flush()
+		} else {
+			current = append(current, line)
+		}
+	}
+	flush()
+	return paragraphs
+}
+
+// splitSentences splits text after each '.', '!' or '?' that is followed by
+// whitespace, trimming the whitespace around each sentence.
+func splitSentences(text string) []string {
+	var sentences []string
+	runes := []rune(text)
+	start := 0
+	for i, r := range runes {
+		if (r == '.' || r == '!' || r == '?') &&
+			i+1 < len(runes) &&
+			unicode.IsSpace(runes[i+1]) {
+			if s := strings.TrimSpace(string(runes[start : i+1])); s != "" {
+				sentences = append(sentences, s)
+			}
+			start = i + 1
+		}
+	}
+	if s := strings.TrimSpace(string(runes[start:])); s != "" {
+		sentences = append(sentences, s)
+	}
+	return sentences
+}
+
+// truncateBytes returns the longest start of s that's at most maxBytes bytes
+// long and doesn't cut a character in two.
+func truncateBytes(s string, maxBytes int) string {
+	if len(s) <= maxBytes {
+		return s
+	}
+	end := maxBytes
+	for end > 0 && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	return s[:end]
+}
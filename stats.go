@@ -0,0 +1,117 @@
+package parrot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// statsSnapshot is the progress of a run at one moment, as written to
+// --stats-json and served at --metrics-addr.
+type statsSnapshot struct {
+	RowsRead       int     `json:"rows_read"`
+	InFlight       int     `json:"in_flight"`
+	Synthesized    int     `json:"synthesized"`
+	Cached         int     `json:"cached"`
+	Skipped        int     `json:"skipped"`
+	Duplicates     int     `json:"duplicates"`
+	TooLong        int     `json:"too_long"`
+	Failed         int     `json:"failed"`
+	Characters     int64   `json:"characters"`
+	Cost           float64 `json:"cost"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+}
+
+// statsReporter takes snapshots of a run's counters for monitoring it while
+// it runs.
+type statsReporter struct {
+	stats *runStats
+	costs *costTracker
+	clock Clock
+	start time.Time
+}
+
+func (r *statsReporter) snapshot() statsSnapshot {
+	r.stats.mu.Lock()
+	snapshot := statsSnapshot{
+		RowsRead:    r.stats.read,
+		InFlight:    r.stats.inFlight,
+		Synthesized: r.stats.counts[rowSynthesized],
+		Cached:      r.stats.counts[rowCached],
+		Skipped:     r.stats.counts[rowSkipped],
+		Duplicates:  r.stats.counts[rowDuplicate],
+		TooLong:     r.stats.counts[rowTooLong],
+		Failed:      r.stats.counts[rowFailed],
+	}
+	r.stats.mu.Unlock()
+	snapshot.Characters = r.costs.characters()
+	snapshot.Cost = r.costs.cost()
+	snapshot.ElapsedSeconds = r.clock.Now().Sub(r.start).Seconds()
+	return snapshot
+}
+
+// writeJSON writes a snapshot to path, replacing what's there all at once so
+// that a reader never sees half of it.
+func (r *statsReporter) writeJSON(path string) error {
+	data, err := json.MarshalIndent(r.snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	})
+}
+
+// writeJSONEvery writes a snapshot to path every interval until stop is
+// closed, logging any that can't be written rather than ending the run.
+func (r *statsReporter) writeJSONEvery(
+	path string,
+	interval time.Duration,
+	log *logger,
+	stop <-chan struct{},
+) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-r.clock.After(interval):
+		}
+		if err := r.writeJSON(path); err != nil {
+			log.logf(logNormal, "writing --stats-json: %v", err)
+		}
+	}
+}
+
+// ServeHTTP serves a snapshot in the Prometheus text format at /metrics, and
+// as JSON anywhere else.
+func (r *statsReporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	snapshot := r.snapshot()
+	if req.URL.Path != "/metrics" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snapshot)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# TYPE parrot_rows_read_total counter\nparrot_rows_read_total %d\n", snapshot.RowsRead)
+	fmt.Fprintf(w, "# TYPE parrot_rows_in_flight gauge\nparrot_rows_in_flight %d\n", snapshot.InFlight)
+	fmt.Fprintf(w, "# TYPE parrot_rows_total counter\n")
+	for _, outcome := range []struct {
+		name  string
+		count int
+	}{
+		{"synthesized", snapshot.Synthesized},
+		{"cached", snapshot.Cached},
+		{"skipped", snapshot.Skipped},
+		{"duplicate", snapshot.Duplicates},
+		{"too_long", snapshot.TooLong},
+		{"failed", snapshot.Failed},
+	} {
+		fmt.Fprintf(w, "parrot_rows_total{outcome=%q} %d\n", outcome.name, outcome.count)
+	}
+	fmt.Fprintf(w, "# TYPE parrot_characters_billed_total counter\nparrot_characters_billed_total %d\n", snapshot.Characters)
+	fmt.Fprintf(w, "# TYPE parrot_cost_dollars_total counter\nparrot_cost_dollars_total %g\n", snapshot.Cost)
+	fmt.Fprintf(w, "# TYPE parrot_elapsed_seconds gauge\nparrot_elapsed_seconds %g\n", snapshot.ElapsedSeconds)
+}
@@ -0,0 +1,93 @@
+package parrot
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// substitution replaces what pattern matches in a row's text with
+// replacement, for --substitutions.
+type substitution struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// loadSubstitutions reads the substitutions in the file at path, which is
+// either a JSON array of objects with pattern and replacement fields, if its
+// name ends in .json, or else CSV with a pattern and a replacement on each
+// line. A pattern between slashes, such as /colou?r/, is a regular expression
+// whose replacement can use $1 and so on for its groups; any other pattern
+// only matches whole words, and its replacement is used as it is.
+func loadSubstitutions(path string) ([]substitution, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var pairs [][2]string
+	if strings.HasSuffix(strings.ToLower(path), ".json") {
+		var entries []struct {
+			Pattern     string `json:"pattern"`
+			Replacement string `json:"replacement"`
+		}
+		if err := json.NewDecoder(f).Decode(&entries); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		for _, entry := range entries {
+			pairs = append(pairs, [2]string{entry.Pattern, entry.Replacement})
+		}
+	} else {
+		reader := csv.NewReader(f)
+		reader.FieldsPerRecord = 2
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("reading %s: %w", path, err)
+			}
+			pairs = append(pairs, [2]string{record[0], record[1]})
+		}
+	}
+
+	substitutions := make([]substitution, 0, len(pairs))
+	for _, pair := range pairs {
+		pattern, replacement := pair[0], pair[1]
+		if pattern == "" {
+			return nil, fmt.Errorf("%s: a pattern can't be empty", path)
+		}
+		var expr string
+		if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			expr = pattern[1 : len(pattern)-1]
+		} else {
+			expr = `\b` + regexp.QuoteMeta(pattern) + `\b`
+			// A plain replacement is used as it is, with no $ expansion.
+			replacement = strings.ReplaceAll(replacement, "$", "$$")
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: pattern %q: %w", path, pattern, err)
+		}
+		substitutions = append(substitutions, substitution{pattern: re, replacement: replacement})
+	}
+	return substitutions, nil
+}
+
+// substitute applies substitutions to text in order, returning the result and
+// how many of them matched.
+func substitute(text string, substitutions []substitution) (string, int) {
+	applied := 0
+	for _, s := range substitutions {
+		if s.pattern.MatchString(text) {
+			text = s.pattern.ReplaceAllString(text, s.replacement)
+			applied++
+		}
+	}
+	return text, applied
+}
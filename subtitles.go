@@ -0,0 +1,164 @@
+package parrot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/polly/types"
+)
+
+// subtitleTail is how long the last cue stays up after its final word
+// starts, since the marks don't say when the audio ends.
+const subtitleTail = 1000
+
+// speechMark is a single line of Polly's speech mark output.
+type speechMark struct {
+	Time  int    `json:"time"`
+	Type  string `json:"type"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+	Value string `json:"value"`
+}
+
+// subtitleCue is a caption shown from start until end, in milliseconds.
+type subtitleCue struct {
+	start int
+	end   int
+	text  string
+}
+
+// parseSpeechMarks parses newline-delimited speech mark JSON.
+func parseSpeechMarks(data []byte) ([]speechMark, error) {
+	var marks []speechMark
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var mark speechMark
+		if err := json.Unmarshal(line, &mark); err != nil {
+			return nil, fmt.Errorf("parsing speech mark %q: %w", line, err)
+		}
+		marks = append(marks, mark)
+	}
+	return marks, scanner.Err()
+}
+
+// filterSpeechMarks returns the lines of data whose type is one of types.
+func filterSpeechMarks(data []byte, types []string) ([]byte, error) {
+	wanted := make(map[string]bool)
+	for _, t := range types {
+		wanted[t] = true
+	}
+	var filtered bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var mark speechMark
+		if err := json.Unmarshal(line, &mark); err != nil {
+			return nil, fmt.Errorf("parsing speech mark %q: %w", line, err)
+		}
+		if wanted[mark.Type] {
+			filtered.Write(line)
+			filtered.WriteByte('\n')
+		}
+	}
+	return filtered.Bytes(), scanner.Err()
+}
+
+// buildCues groups word marks into cues of at most maxChars characters,
+// starting a new cue at each sentence mark. Each cue ends when the next one
+// starts, so cues never overlap.
+func buildCues(marks []speechMark, maxChars int) []subtitleCue {
+	var cues []subtitleCue
+	var words []string
+	cueStart := 0
+	cueLen := 0
+	newSentence := false
+	finish := func(end int) {
+		if len(words) == 0 {
+			return
+		}
+		if end <= cueStart {
+			end = cueStart + 1
+		}
+		cues = append(cues, subtitleCue{
+			start: cueStart,
+			end:   end,
+			text:  strings.Join(words, " "),
+		})
+		words = nil
+		cueLen = 0
+	}
+
+	lastWordTime := 0
+	for _, mark := range marks {
+		switch types.SpeechMarkType(mark.Type) {
+		case types.SpeechMarkTypeSentence:
+			newSentence = true
+		case types.SpeechMarkTypeWord:
+			wordLen := len([]rune(mark.Value))
+			if newSentence || (cueLen > 0 && cueLen+1+wordLen > maxChars) {
+				finish(mark.Time)
+			}
+			newSentence = false
+			if len(words) == 0 {
+				cueStart = mark.Time
+			} else {
+				cueLen++
+			}
+			words = append(words, mark.Value)
+			cueLen += wordLen
+			lastWordTime = mark.Time
+		}
+	}
+	finish(lastWordTime + subtitleTail)
+	return cues
+}
+
+// formatCueTime formats ms as hh:mm:ss followed by sep and the milliseconds.
+func formatCueTime(ms int, sep string) string {
+	return fmt.Sprintf(
+		"%02d:%02d:%02d%s%03d",
+		ms/3600000,
+		ms/60000%60,
+		ms/1000%60,
+		sep,
+		ms%1000)
+}
+
+// writeSubtitles writes cues to w in the given format, srt or vtt.
+func writeSubtitles(w io.Writer, cues []subtitleCue, format string) error {
+	sep := ","
+	if format == "vtt" {
+		sep = "."
+		if _, err := io.WriteString(w, "WEBVTT\n\n"); err != nil {
+			return err
+		}
+	}
+	for i, cue := range cues {
+		if format == "srt" {
+			if _, err := fmt.Fprintf(w, "%d\n", i+1); err != nil {
+				return err
+			}
+		}
+		_, err := fmt.Fprintf(
+			w,
+			"%s --> %s\n%s\n\n",
+			formatCueTime(cue.start, sep),
+			formatCueTime(cue.end, sep),
+			cue.text)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
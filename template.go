@@ -0,0 +1,92 @@
+package parrot
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// columnVariable matches the $1, $2... variables a text template can use for
+// a row's columns, and templateAction the actions they can be used in.
+var (
+	columnVariable = regexp.MustCompile(`\$([0-9]+)`)
+	templateAction = regexp.MustCompile(`(?s)\{\{.*?\}\}`)
+)
+
+// textTemplate renders each row into the text to synthesize, for
+// --text-template. Its data is the row's columns by name, with --header, and
+// $1, $2 and so on are set to its first, second and later columns, or to ""
+// past the end of a row that's short of them.
+type textTemplate struct {
+	tmpl *template.Template
+	// record is the row being rendered, which the column function reads.
+	record []string
+}
+
+// newTextTemplate parses text, so that a template that's wrong is found
+// before any row is read.
+func newTextTemplate(text string) (*textTemplate, error) {
+	t := &textTemplate{}
+	// Each $N the template's actions use is declared ahead of it, as
+	// text/template only has the variables a template declares. A $ in the
+	// text around them, such as "$5", is only text.
+	highest := 0
+	for _, action := range templateAction.FindAllString(text, -1) {
+		for _, match := range columnVariable.FindAllStringSubmatch(action, -1) {
+			if n, err := strconv.Atoi(match[1]); err == nil && n > highest {
+				highest = n
+			}
+		}
+	}
+	var declarations strings.Builder
+	for n := 1; n <= highest; n++ {
+		fmt.Fprintf(&declarations, "{{$%d := columnOrEmpty %d}}", n, n)
+	}
+
+	tmpl, err := template.New("text").
+		Option("missingkey=error").
+		Funcs(template.FuncMap{"column": t.column, "columnOrEmpty": t.columnOrEmpty}).
+		Parse(declarations.String() + text)
+	if err != nil {
+		return nil, fmt.Errorf("--text-template: %w", err)
+	}
+	t.tmpl = tmpl
+	return t, nil
+}
+
+// column returns the nth column of the row being rendered, counting from 1.
+func (t *textTemplate) column(n int) (string, error) {
+	if n < 1 || n > len(t.record) {
+		return "", fmt.Errorf("column %d doesn't exist, as the row has %d columns", n, len(t.record))
+	}
+	return t.record[n-1], nil
+}
+
+// columnOrEmpty returns the nth column of the row being rendered, or "" if
+// the row doesn't have one. It's what $N is declared with, so that a row
+// without a column the template only uses some of the time still renders.
+func (t *textTemplate) columnOrEmpty(n int) string {
+	if n > len(t.record) {
+		return ""
+	}
+	return t.record[n-1]
+}
+
+// render returns the text of record, whose columns are named by header, if
+// there is one.
+func (t *textTemplate) render(record []string, header []string) (string, error) {
+	data := make(map[string]string, len(header))
+	for i, name := range header {
+		if i < len(record) {
+			data[name] = record[i]
+		}
+	}
+	t.record = record
+	var text strings.Builder
+	if err := t.tmpl.Execute(&text, data); err != nil {
+		return "", err
+	}
+	return text.String(), nil
+}
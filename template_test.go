@@ -0,0 +1,68 @@
+package parrot
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTextTemplateRender(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		record   []string
+		header   []string
+		want     string
+	}{
+		{
+			name:     "columns",
+			template: "{{$2}}, {{$1}}",
+			record:   []string{"world", "hello"},
+			want:     "hello, world",
+		},
+		{
+			name:     "header",
+			template: "Dear {{.name}}",
+			record:   []string{"Ada"},
+			header:   []string{"name"},
+			want:     "Dear Ada",
+		},
+		{
+			name:     "literal dollar amount",
+			template: "It costs $5 for {{$1}}",
+			record:   []string{"one"},
+			want:     "It costs $5 for one",
+		},
+		{
+			name:     "row narrower than the highest column",
+			template: "{{$1}}{{if $3}} and {{$3}}{{end}}",
+			record:   []string{"one"},
+			want:     "one",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tmpl, err := newTextTemplate(test.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := tmpl.render(test.record, test.header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTextTemplateMissingColumn(t *testing.T) {
+	tmpl, err := newTextTemplate("{{column 3}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tmpl.render([]string{"one"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "column 3 doesn't exist") {
+		t.Errorf("got %v, want column 3 to be missing", err)
+	}
+}
@@ -0,0 +1,383 @@
+package parrot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Validate reads the input options names, without calling AWS or writing
+// anything, and checks every row as Run would before synthesizing it: that it
+// can be read, that it isn't blank, that it has text, that it has as many columns as the first,
+// that its columns exist, that its text is valid UTF-8, that it has a voice
+// and language, and that it isn't a duplicate that --on-duplicate wouldn't
+// allow. It returns every problem it finds, each naming its line, in the
+// order of the lines. An error is only returned if the input couldn't be
+// checked at all. With ReportUnsupportedCharacters set, it also checks each
+// row's text as CheckCharacters does.
+func Validate(ctx context.Context, options Config) ([]error, error) {
+	return validate(ctx, options, false)
+}
+
+// CheckCharacters reads the input options names, without calling AWS or
+// writing anything, and returns a problem for each row whose text has
+// characters that aren't expected in its language: those outside the scripts
+// expected for the language, or AllowedScripts if set, and AllowedCharacters,
+// along with control characters and the replacement character. Rows that
+// can't be read or are otherwise invalid aren't reported, as Validate does
+// that.
+func CheckCharacters(ctx context.Context, options Config) ([]error, error) {
+	return validate(ctx, options, true)
+}
+
+// validate checks the input for Validate, or only checks its characters for
+// CheckCharacters if charactersOnly is set.
+func validate(ctx context.Context, options Config, charactersOnly bool) ([]error, error) {
+	if options.InputFormat == "jsonl" {
+		options.Header = true
+		options.Column = options.TextField
+		options.VoiceColumn = options.VoiceField
+		options.LanguageColumn = options.LanguageField
+	}
+	inputs, err := expandInputs(options.Input)
+	if err != nil {
+		return nil, err
+	}
+	delimiter, err := parseDelimiter(options.Delimiter)
+	if err != nil {
+		return nil, err
+	}
+	inputEncoding, err := parseInputEncoding(options.InputEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("--input-encoding: %w", err)
+	}
+	if inputEncoding != nil && options.InputFormat == "jsonl" {
+		return nil, errors.New("--input-encoding only applies to CSV input; JSONL is always UTF-8")
+	}
+	var textTmpl *textTemplate
+	if options.TextTemplate != "" {
+		if textTmpl, err = newTextTemplate(options.TextTemplate); err != nil {
+			return nil, err
+		}
+	}
+	var substitutions []substitution
+	if options.Substitutions != "" {
+		if substitutions, err = loadSubstitutions(options.Substitutions); err != nil {
+			return nil, fmt.Errorf("--substitutions: %w", err)
+		}
+	}
+	var comment rune
+	if options.Comment != "" {
+		if comment, err = parseDelimiter(options.Comment); err != nil {
+			return nil, fmt.Errorf("--comment: %w", err)
+		}
+	}
+	checkCharacters := charactersOnly || options.ReportUnsupportedCharacters
+	var allowedScripts []string
+	for _, list := range options.AllowedScripts {
+		for _, script := range strings.Split(list, ",") {
+			if script = strings.TrimSpace(script); script != "" {
+				allowedScripts = append(allowedScripts, script)
+			}
+		}
+	}
+	// characterSets holds the characters expected for each language, as
+	// they're needed.
+	characterSets := make(map[string]*characterSet)
+	if checkCharacters {
+		set, err := newCharacterSet(options.Language, allowedScripts, options.AllowedCharacters)
+		if err != nil {
+			return nil, err
+		}
+		characterSets[options.Language] = set
+	}
+
+	voices := []string{options.Voice}
+	if len(options.CompareVoices) > 0 || len(options.Voices) > 0 {
+		voices = nil
+		for _, list := range append(options.CompareVoices, options.Voices...) {
+			for _, voice := range strings.Split(list, ",") {
+				if voice = strings.TrimSpace(voice); voice != "" {
+					voices = append(voices, voice)
+				}
+			}
+		}
+	}
+	if len(voices) == 0 {
+		voices = []string{""}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	records := make(chan CSVRecord)
+	readDone := make(chan error, 1)
+	readLimit := options.Limit
+	if readLimit > 0 {
+		readLimit += options.Skip
+	}
+	// Rows are read as if their widths could vary, and past lines that can't
+	// be read, so that every problem is found and not just the first.
+	read := func(ctx context.Context, path string, records chan<- CSVRecord) error {
+		if options.InputFormat == "jsonl" {
+			return ReadJSONLFile(ctx, path, JSONLReadOptions{
+				Gzipped:    options.GzipInput,
+				AllowBlank: options.AllowBlankLines,
+				KeepGoing:  true,
+			}, records)
+		}
+		return ReadCSVFile(ctx, path, CSVReadOptions{
+			Gzipped:    options.GzipInput,
+			Encoding:   inputEncoding,
+			Delimiter:  delimiter,
+			Comment:    comment,
+			AllowBlank: options.AllowBlankLines,
+			Ragged:     true,
+			LazyQuotes: options.LazyQuotes,
+			KeepGoing:  true,
+		}, records)
+	}
+	go func() {
+		readDone <- readInputs(ctx, inputs, options.Header, readLimit, read, records)
+	}()
+	// drain stops the reader and waits for it, for when checking can't
+	// carry on.
+	drain := func() {
+		cancel()
+		for range records {
+		}
+		<-readDone
+	}
+
+	var problems []rowError
+	var header []string
+	for options.Header && header == nil {
+		r, ok := <-records
+		if !ok {
+			if err := <-readDone; err != nil {
+				return nil, err
+			}
+			return nil, errors.New("--header given but the input is empty")
+		}
+		if r.err != nil {
+			if !charactersOnly {
+				problems = append(problems, rowError{input: r.input, lineNo: r.lineNo, err: r.err})
+			}
+			continue
+		}
+		header = r.record
+	}
+	column, err := resolveColumn(options.Column, header)
+	if err != nil {
+		drain()
+		return nil, fmt.Errorf("--column: %w", err)
+	}
+	voiceColumn, err := resolveColumn(options.VoiceColumn, header)
+	if err != nil {
+		drain()
+		return nil, fmt.Errorf("--voice-column: %w", err)
+	}
+	languageColumn, err := resolveColumn(options.LanguageColumn, header)
+	if err != nil {
+		drain()
+		return nil, fmt.Errorf("--language-column: %w", err)
+	}
+	ssmlColumn, err := resolveColumn(options.SSMLColumn, header)
+	if err != nil {
+		drain()
+		return nil, fmt.Errorf("--ssml-column: %w", err)
+	}
+	fallbackColumn, err := resolveColumn(options.FallbackColumn, header)
+	if err != nil {
+		drain()
+		return nil, fmt.Errorf("--fallback-column: %w", err)
+	}
+	textColumns, err := resolveColumns(options.TextColumns, header)
+	if err != nil {
+		drain()
+		return nil, fmt.Errorf("--text-columns: %w", err)
+	}
+	if textColumns == nil {
+		textColumns = []int{column}
+	}
+	namer, err := newAudioNamer(options.Naming, options.FilenameColumn, header)
+	if err != nil {
+		drain()
+		return nil, err
+	}
+
+	seen := NewSeenTracker()
+	seen.Start()
+	defer seen.Stop()
+
+	numColumns := len(header)
+	dataRows := 0
+	for r := range records {
+		if r.err != nil {
+			if !charactersOnly {
+				problems = append(problems, rowError{input: r.input, lineNo: r.lineNo, err: r.err})
+			}
+			continue
+		}
+		record := r.record
+		dataRows++
+		if dataRows <= options.Skip {
+			continue
+		}
+		report := func(format string, args ...interface{}) {
+			err := rowError{input: r.input, lineNo: r.lineNo, err: fmt.Errorf(format, args...)}
+			problems = append(problems, err)
+		}
+		fail := func(format string, args ...interface{}) {
+			if !charactersOnly {
+				report(format, args...)
+			}
+		}
+
+		if !options.AllowBlankLines && isBlankRecord(record) {
+			fail("blank line")
+			continue
+		}
+		if numColumns == 0 {
+			numColumns = r.width
+		}
+		if r.width != numColumns && !options.RaggedColumns {
+			fail("expected %d columns but found %d columns", numColumns, r.width)
+			continue
+		}
+		missing := false
+		for _, c := range append([]int{voiceColumn, languageColumn, ssmlColumn, fallbackColumn, namer.column}, textColumns...) {
+			if c >= len(record) {
+				fail("column %d doesn't exist, as the row has %d columns", c, len(record))
+				missing = true
+				break
+			}
+		}
+		if missing {
+			continue
+		}
+		if options.AudioColumnPosition > len(record) {
+			fail("--audio-column-position %d is past the end of the row, which has %d columns",
+				options.AudioColumnPosition,
+				len(record))
+			continue
+		}
+
+		// Each of --text-columns is checked as a row of its own would be.
+		for _, column := range textColumns {
+			text := record[column]
+			if textTmpl != nil {
+				if text, err = textTmpl.render(record, header); err != nil {
+					fail("%v", err)
+					continue
+				}
+			}
+			if !utf8.ValidString(text) {
+				report("text isn't valid UTF-8")
+				continue
+			}
+			if options.Normalize {
+				text = normalizeText(text, options.NormalizeLowercase)
+			} else if options.TrimKey {
+				text = trimKey(text)
+			}
+			text, _ = substitute(text, substitutions)
+			usedFallback := false
+			if fallbackColumn >= 0 && strings.TrimSpace(text) == "" {
+				text = record[fallbackColumn]
+				if options.Normalize {
+					text = normalizeText(text, options.NormalizeLowercase)
+				} else if options.TrimKey {
+					text = trimKey(text)
+				}
+				text, _ = substitute(text, substitutions)
+				usedFallback = strings.TrimSpace(text) != ""
+			}
+			if strings.TrimSpace(text) == "" {
+				if !options.AllowBlankLines && !options.SkipEmptyText && !options.WriteEmptyAudioOnEmptyText {
+					fail("empty text")
+				}
+				continue
+			}
+			if _, err := rowIsSSML(text, record, ssmlColumn, options.SSML, options.DetectSSML); err != nil && !usedFallback {
+				fail("%v", err)
+				continue
+			}
+
+			rowLanguage := options.Language
+			if languageColumn >= 0 && record[languageColumn] != "" {
+				rowLanguage = record[languageColumn]
+			}
+			rowVoices := voices
+			if voiceColumn >= 0 && record[voiceColumn] != "" {
+				rowVoices = []string{record[voiceColumn]}
+			}
+			if rowLanguage == "" || rowVoices[0] == "" {
+				fail("no voice or language given")
+				continue
+			}
+			if checkCharacters {
+				set := characterSets[rowLanguage]
+				if set == nil {
+					if set, err = newCharacterSet(rowLanguage, allowedScripts, options.AllowedCharacters); err != nil {
+						drain()
+						return nil, err
+					}
+					characterSets[rowLanguage] = set
+				}
+				if found := set.unsupported(text); found != "" {
+					report("unsupported characters for %s: %s", rowLanguage, found)
+				}
+				if charactersOnly {
+					continue
+				}
+			}
+
+			// As Run does, only the same text in the same language and voices
+			// is a duplicate.
+			firstLineNo, dup := seen.Lookup(synthesisKey(text, rowLanguage, rowVoices), r.lineNo)
+			if !dup {
+				dir := ""
+				if options.PartitionBy != "" {
+					dir = rowLanguage
+				}
+				nameText := rowNameText(
+					text,
+					rowLanguage,
+					rowVoices,
+					options.Language,
+					voices,
+					options.PartitionBy != "")
+				if _, err := namer.name(nameText, record, dataRows, dir); err != nil {
+					fail("%v", err)
+				}
+				continue
+			}
+			if options.OnDuplicate == "error" {
+				fail("duplicate \"%s\", previously on line %d", text, firstLineNo)
+			}
+		}
+	}
+	if err := <-readDone; err != nil {
+		return nil, err
+	}
+
+	// With several inputs, problems are ordered by input and then by line.
+	inputOrder := make(map[string]int, len(inputs))
+	for i, input := range inputs {
+		inputOrder[input] = i
+	}
+	sort.SliceStable(problems, func(i, j int) bool {
+		if a, b := inputOrder[problems[i].input], inputOrder[problems[j].input]; a != b {
+			return a < b
+		}
+		return problems[i].lineNo < problems[j].lineNo
+	})
+	errs := make([]error, len(problems))
+	for i, problem := range problems {
+		errs[i] = problem
+	}
+	return errs, nil
+}
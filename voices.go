@@ -0,0 +1,195 @@
+package parrot
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/polly"
+	"github.com/aws/aws-sdk-go-v2/service/polly/types"
+)
+
+// ListVoices writes a table of the voices Polly offers to w, limited to
+// those that speak languageCode, are of gender and support engine, leaving out
+// each of those that's empty.
+func ListVoices(
+	ctx context.Context,
+	client Synthesizer,
+	languageCode string,
+	gender string,
+	engine string,
+	w io.Writer,
+) error {
+	voices, err := describeVoices(ctx, client)
+	if err != nil {
+		return err
+	}
+	catalog := make(voiceCatalog, len(voices))
+	for i, voice := range voices {
+		catalog[string(voice.Id)] = &voices[i]
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VOICE\tGENDER\tENGINES\tLANGUAGE")
+	for _, voice := range voices {
+		if gender != "" && !strings.EqualFold(string(voice.Gender), gender) {
+			continue
+		}
+		if (languageCode != "" || engine != "") &&
+			catalog.check(string(voice.Id), languageCode, engine) != nil {
+			continue
+		}
+		engines := make([]string, len(voice.SupportedEngines))
+		for i, supported := range voice.SupportedEngines {
+			engines[i] = string(supported)
+		}
+		fmt.Fprintf(
+			tw,
+			"%s\t%s\t%s\t%s\n",
+			voice.Id,
+			voice.Gender,
+			strings.Join(engines, ","),
+			aws.ToString(voice.LanguageName))
+	}
+	return tw.Flush()
+}
+
+// voiceCatalog holds the voices Polly offers, indexed by voice ID, so they
+// only have to be described once.
+type voiceCatalog map[string]*types.Voice
+
+func loadVoiceCatalog(ctx context.Context, client Synthesizer) (voiceCatalog, error) {
+	voices, err := describeVoices(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	catalog := make(voiceCatalog)
+	for i, voice := range voices {
+		catalog[string(voice.Id)] = &voices[i]
+	}
+	return catalog, nil
+}
+
+// describeVoices returns every voice Polly offers, along with the additional
+// languages each speaks, following NextToken through all of the pages.
+func describeVoices(ctx context.Context, client Synthesizer) ([]types.Voice, error) {
+	input := &polly.DescribeVoicesInput{
+		IncludeAdditionalLanguageCodes: true,
+	}
+	var voices []types.Voice
+	for {
+		resp, err := client.DescribeVoices(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		voices = append(voices, resp.Voices...)
+		if aws.ToString(resp.NextToken) == "" {
+			return voices, nil
+		}
+		input.NextToken = resp.NextToken
+	}
+}
+
+// check returns an error unless voiceID exists, speaks languageCode and
+// supports engine. An empty languageCode or engine isn't checked.
+func (c voiceCatalog) check(voiceID, languageCode, engine string) error {
+	voice, ok := c[voiceID]
+	if !ok {
+		return fmt.Errorf("unknown voice %q", voiceID)
+	}
+
+	if languageCode != "" {
+		speaks := string(voice.LanguageCode) == languageCode
+		for _, additional := range voice.AdditionalLanguageCodes {
+			speaks = speaks || string(additional) == languageCode
+		}
+		if !speaks {
+			return fmt.Errorf(
+				"voice %s doesn't support language %s",
+				voiceID,
+				languageCode)
+		}
+	}
+
+	if engine == "" {
+		return nil
+	}
+	for _, supported := range voice.SupportedEngines {
+		if string(supported) == engine {
+			return nil
+		}
+	}
+	return fmt.Errorf("voice %s doesn't support the %s engine", voiceID, engine)
+}
+
+// speakingStyleVoices holds the voices that have each of the neural speaking
+// styles. Polly's catalog doesn't say which voices have which styles, so this
+// follows its documentation.
+var speakingStyleVoices = map[string][]string{
+	"news":           {"Amy", "Joanna", "Lupe", "Matthew"},
+	"conversational": {"Joanna", "Matthew"},
+}
+
+// checkSpeakingStyle returns an error unless voiceID has style.
+func checkSpeakingStyle(voiceID string, style string) error {
+	for _, id := range speakingStyleVoices[style] {
+		if id == voiceID {
+			return nil
+		}
+	}
+	return fmt.Errorf(
+		"voice %s doesn't have the %s speaking style, which only %s have",
+		voiceID,
+		style,
+		strings.Join(speakingStyleVoices[style], ", "))
+}
+
+// warmUp synthesizes a single character with voice, so that credentials that
+// can read the catalog but not synthesize speech are found before any input is
+// read rather than at the first row. An empty voice, as when each row names
+// its own, is replaced by the first in the catalog with engine. A voice
+// without engine is tried with the standard engine, as
+// --voice-engine-fallback would.
+func warmUp(
+	ctx context.Context,
+	client Synthesizer,
+	catalog voiceCatalog,
+	voice string,
+	engine string,
+	format string,
+) error {
+	if voice == "" {
+		ids := make([]string, 0, len(catalog))
+		for id := range catalog {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			if catalog.check(id, "", engine) == nil {
+				voice = id
+				break
+			}
+		}
+		if voice == "" {
+			return fmt.Errorf("no voice supports the %s engine", engine)
+		}
+	}
+	if catalog.check(voice, "", engine) != nil {
+		engine = string(types.EngineStandard)
+	}
+	resp, err := client.SynthesizeSpeech(ctx, &polly.SynthesizeSpeechInput{
+		Engine:       types.Engine(engine),
+		OutputFormat: types.OutputFormat(format),
+		Text:         aws.String("."),
+		VoiceId:      types.VoiceId(voice),
+		LanguageCode: catalog[voice].LanguageCode,
+	})
+	if err != nil {
+		return fmt.Errorf("synthesizing with %s: %w", voice, err)
+	}
+	return resp.AudioStream.Close()
+}
@@ -0,0 +1,98 @@
+package parrot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strconv"
+)
+
+const (
+	// formatWAV stands in for a Polly output format for audio files that are
+	// PCM wrapped in a WAV header, with --wav.
+	formatWAV = "wav"
+
+	// wavHeaderLen is the length of a canonical WAV header, with a fmt chunk
+	// for PCM and the header of the data chunk.
+	wavHeaderLen = 44
+
+	// defaultPCMSampleRate is the rate Polly uses for PCM when none is asked
+	// for. Its PCM is always signed 16-bit little-endian mono.
+	defaultPCMSampleRate = 16000
+)
+
+// wavHeader returns the WAV header for dataLen bytes of Polly's PCM audio at
+// sampleRate.
+func wavHeader(sampleRate int, dataLen int64) []byte {
+	const channels, bitsPerSample = 1, 16
+	blockAlign := channels * bitsPerSample / 8
+	header := make([]byte, wavHeaderLen)
+	le := binary.LittleEndian
+	copy(header[0:], "RIFF")
+	le.PutUint32(header[4:], uint32(wavHeaderLen-8+dataLen))
+	copy(header[8:], "WAVEfmt ")
+	le.PutUint32(header[16:], 16)
+	le.PutUint16(header[20:], 1) // PCM
+	le.PutUint16(header[22:], channels)
+	le.PutUint32(header[24:], uint32(sampleRate))
+	le.PutUint32(header[28:], uint32(sampleRate*blockAlign))
+	le.PutUint16(header[32:], uint16(blockAlign))
+	le.PutUint16(header[34:], bitsPerSample)
+	copy(header[36:], "data")
+	le.PutUint32(header[40:], uint32(dataLen))
+	return header
+}
+
+// pcmSampleRate returns the sample rate Polly's PCM audio will have when
+// sampleRate, which may be empty, is asked for.
+func pcmSampleRate(sampleRate string) int {
+	if rate, err := strconv.Atoi(sampleRate); err == nil {
+		return rate
+	}
+	return defaultPCMSampleRate
+}
+
+// writeWAV writes the PCM audio that write writes to w as a WAV file. As the
+// header holds the length of the audio, which isn't known until it's all been
+// written, a header is written first and filled in afterwards if w can seek,
+// and otherwise the audio is held in memory until it's done.
+func writeWAV(w io.Writer, sampleRate int, write func(io.Writer) error) error {
+	if ws, ok := w.(io.WriteSeeker); ok {
+		if _, err := ws.Write(wavHeader(sampleRate, 0)); err != nil {
+			return err
+		}
+		counter := &countingWriter{w: ws}
+		if err := write(counter); err != nil {
+			return err
+		}
+		if _, err := ws.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := ws.Write(wavHeader(sampleRate, counter.n)); err != nil {
+			return err
+		}
+		_, err := ws.Seek(0, io.SeekEnd)
+		return err
+	}
+	var audio bytes.Buffer
+	if err := write(&audio); err != nil {
+		return err
+	}
+	if _, err := w.Write(wavHeader(sampleRate, int64(audio.Len()))); err != nil {
+		return err
+	}
+	_, err := audio.WriteTo(w)
+	return err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,398 @@
+package parrot
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CSVWriteOptions is how WriteCSV writes CSV.
+type CSVWriteOptions struct {
+	Delimiter rune
+	// AlwaysQuote quotes every field, rather than only those that need it.
+	AlwaysQuote bool
+	UseCRLF     bool
+	// Unless FlushRows and FlushInterval are 0, what's been written is
+	// flushed every FlushRows records or every FlushInterval, rather than
+	// only at the end.
+	FlushRows     int
+	FlushInterval time.Duration
+}
+
+// WriteCSV writes every record received on records to w as CSV as format
+// says, returning once records is closed. After a write error the remaining
+// records are drained and discarded so the sender never blocks, and the first
+// error is returned. Flushing what's been written flushes w too, if it can
+// be.
+func WriteCSV(w io.Writer, format CSVWriteOptions, records <-chan CSVRecord) error {
+	buffered := bufio.NewWriter(w)
+	csvwriter := csv.NewWriter(buffered)
+	csvwriter.Comma = format.Delimiter
+	csvwriter.UseCRLF = format.UseCRLF
+	write := func(record []string) error {
+		if !loneEmptyField(record) {
+			return csvwriter.Write(record)
+		}
+		// What csvwriter holds goes first, as this bypasses it.
+		csvwriter.Flush()
+		if err := csvwriter.Error(); err != nil {
+			return err
+		}
+		return writeQuoted(buffered, record, format)
+	}
+	if format.AlwaysQuote {
+		write = func(record []string) error {
+			return writeQuoted(buffered, record, format)
+		}
+	}
+	var ticks <-chan time.Time
+	if format.FlushInterval > 0 {
+		ticker := time.NewTicker(format.FlushInterval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	flush := func() error {
+		csvwriter.Flush()
+		if err := csvwriter.Error(); err != nil {
+			return err
+		}
+		if err := buffered.Flush(); err != nil {
+			return err
+		}
+		if f, ok := w.(interface{ Flush() error }); ok {
+			return f.Flush()
+		}
+		return nil
+	}
+
+	var err error
+	unflushed := 0
+	for {
+		select {
+		case r, ok := <-records:
+			if !ok {
+				if err != nil {
+					return err
+				}
+				csvwriter.Flush()
+				if err := csvwriter.Error(); err != nil {
+					return err
+				}
+				return buffered.Flush()
+			}
+			if err != nil {
+				continue
+			}
+			err = write(r.record)
+			unflushed++
+			if err == nil && format.FlushRows > 0 && unflushed >= format.FlushRows {
+				err = flush()
+				unflushed = 0
+			}
+		case <-ticks:
+			if err == nil && unflushed > 0 {
+				err = flush()
+				unflushed = 0
+			}
+		}
+	}
+}
+
+// loneEmptyField reports whether record is a single empty field, which
+// encoding/csv writes as an empty line that readers, ReadCSVFile among them,
+// skip, so that it has to be quoted to be read back.
+func loneEmptyField(record []string) bool {
+	return len(record) == 1 && record[0] == ""
+}
+
+// writeQuoted writes record to w as a line of CSV with every field quoted.
+// Line breaks in fields are written as encoding/csv writes them, as \r\n with
+// UseCRLF set.
+func writeQuoted(w *bufio.Writer, record []string, format CSVWriteOptions) error {
+	for i, field := range record {
+		if i > 0 {
+			w.WriteRune(format.Delimiter)
+		}
+		field = strings.ReplaceAll(field, `"`, `""`)
+		if format.UseCRLF {
+			field = strings.ReplaceAll(field, "\r", "")
+			field = strings.ReplaceAll(field, "\n", "\r\n")
+		}
+		w.WriteByte('"')
+		w.WriteString(field)
+		w.WriteByte('"')
+	}
+	if format.UseCRLF {
+		w.WriteString("\r\n")
+	} else {
+		w.WriteByte('\n')
+	}
+	// Write errors stick, so the last one says whether any failed.
+	_, err := w.Write(nil)
+	return err
+}
+
+// parseFlushInterval parses --flush-interval, which is either a number of
+// rows or a duration such as 30s, returning one or the other. An empty
+// interval means only flushing at the end.
+func parseFlushInterval(s string) (int, time.Duration, error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	if rows, err := strconv.Atoi(s); err == nil {
+		if rows < 1 {
+			return 0, 0, errors.New("--flush-interval must be at least 1 row")
+		}
+		return rows, 0, nil
+	}
+	interval, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, 0, fmt.Errorf(
+			"--flush-interval %q must be a number of rows or a duration such as 30s",
+			s)
+	} else if interval <= 0 {
+		return 0, 0, errors.New("--flush-interval must be longer than 0s")
+	}
+	return 0, interval, nil
+}
+
+// placeColumns sends each record received on records on to the channel it
+// returns with its last n columns moved to start at the zero-based index
+// position, shifting the columns from there on along. The returned channel is
+// closed once records is.
+func placeColumns(records <-chan CSVRecord, n int, position int) <-chan CSVRecord {
+	placed := make(chan CSVRecord)
+	go func() {
+		defer close(placed)
+		for r := range records {
+			split := len(r.record) - n
+			if position < split {
+				record := make([]string, 0, len(r.record))
+				record = append(record, r.record[:position]...)
+				record = append(record, r.record[split:]...)
+				r.record = append(record, r.record[position:split]...)
+			}
+			placed <- r
+		}
+	}()
+	return placed
+}
+
+// textColumnMarker returns the marker that ends the record made for the
+// column'th of --text-columns of the row'th row, which mergeTextColumns puts
+// the row back together by.
+func textColumnMarker(row int, column int) string {
+	return strconv.Itoa(row) + ":" + strconv.Itoa(column)
+}
+
+// mergeTextColumns sends the records received on records on to the channel it
+// returns with those made for each of the n text columns of a row put back
+// together as one. Each record has the row's columns, then the marker from
+// textColumnMarker, then extra columns of its own. The row is sent with its
+// columns and then the extra columns made for each text column in turn, which
+// are left empty for a text column that has no record, such as one that
+// failed. With header set, the first record is the header and is sent on as
+// it is. The returned channel is closed once records is.
+func mergeTextColumns(records <-chan CSVRecord, n int, extra int, header bool) <-chan CSVRecord {
+	merged := make(chan CSVRecord)
+	go func() {
+		defer close(merged)
+		var row CSVRecord
+		var rowMarker string
+		var parts [][]string
+		send := func() {
+			record := append([]string(nil), row.record...)
+			for _, part := range parts {
+				if part == nil {
+					part = make([]string, extra)
+				}
+				record = append(record, part...)
+			}
+			row.record = record
+			merged <- row
+		}
+		for r := range records {
+			if header {
+				header = false
+				merged <- r
+				continue
+			}
+			split := len(r.record) - extra - 1
+			marker := r.record[split]
+			sep := strings.LastIndexByte(marker, ':')
+			column, _ := strconv.Atoi(marker[sep+1:])
+			if parts != nil && marker[:sep] != rowMarker {
+				send()
+				parts = nil
+			}
+			if parts == nil {
+				row = CSVRecord{lineNo: r.lineNo, record: r.record[:split]}
+				rowMarker = marker[:sep]
+				parts = make([][]string, n)
+			}
+			parts[column] = r.record[split+1:]
+		}
+		if parts != nil {
+			send()
+		}
+	}()
+	return merged
+}
+
+// splitVoices sends each record received on records on to the channel it
+// returns as one record per voice, each with the columns from before the
+// voices' columns, then the voice, then its own n columns. With header set,
+// the first record is the header and is sent on as it is. The returned
+// channel is closed once records is.
+func splitVoices(records <-chan CSVRecord, voices []string, n int, header bool) <-chan CSVRecord {
+	split := make(chan CSVRecord)
+	go func() {
+		defer close(split)
+		for r := range records {
+			if header {
+				header = false
+				split <- r
+				continue
+			}
+			shared := r.record[:len(r.record)-n*len(voices)]
+			for i, voice := range voices {
+				record := make([]string, 0, len(shared)+1+n)
+				record = append(record, shared...)
+				record = append(record, voice)
+				start := len(shared) + i*n
+				record = append(record, r.record[start:start+n]...)
+				split <- CSVRecord{lineNo: r.lineNo, record: record}
+			}
+		}
+	}()
+	return split
+}
+
+// writeRotatedCSV writes every record received on records as CSV as format
+// says, gzipped if compress is set, to a series of parts that open creates,
+// numbered from 1, starting a new part before a record that would take the
+// current one past maxRows rows or maxBytes bytes of uncompressed CSV,
+// leaving out each limit that's 0. With header set, the first record is the
+// header and is written at the top of every part. A part is written even if
+// there are no records. It returns the names of the parts, once records is
+// closed; after an error the remaining records are drained and discarded so
+// the sender never blocks, and the first error is returned.
+func writeRotatedCSV(
+	open func(part int) (io.WriteCloser, string, error),
+	compress bool,
+	format CSVWriteOptions,
+	maxRows int,
+	maxBytes int64,
+	header bool,
+	records <-chan CSVRecord,
+) ([]string, error) {
+	var names []string
+	var headerRecord *CSVRecord
+	var file io.WriteCloser
+	var part chan CSVRecord
+	var done chan error
+	rows, size := 0, int64(0)
+	start := func() error {
+		var name string
+		var err error
+		if file, name, err = open(len(names) + 1); err != nil {
+			return err
+		}
+		names = append(names, name)
+		part = make(chan CSVRecord)
+		done = make(chan error, 1)
+		go func(w io.Writer, part <-chan CSVRecord) {
+			if compress {
+				done <- WriteGzipCSV(w, format, part)
+			} else {
+				done <- WriteCSV(w, format, part)
+			}
+		}(file, part)
+		rows, size = 0, 0
+		if headerRecord != nil {
+			part <- *headerRecord
+			size += encodedCSVLen(headerRecord.record, format)
+		}
+		return nil
+	}
+	finish := func() error {
+		close(part)
+		part = nil
+		err := <-done
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+
+	var err error
+	for r := range records {
+		if err != nil {
+			continue
+		}
+		if header && headerRecord == nil {
+			headerRecord = &CSVRecord{lineNo: r.lineNo, record: r.record}
+			continue
+		}
+		n := encodedCSVLen(r.record, format)
+		if part != nil && rows > 0 &&
+			(maxRows > 0 && rows >= maxRows || maxBytes > 0 && size+n > maxBytes) {
+			if err = finish(); err != nil {
+				continue
+			}
+		}
+		if part == nil {
+			if err = start(); err != nil {
+				continue
+			}
+		}
+		part <- r
+		rows++
+		size += n
+	}
+	if part == nil && err == nil && len(names) == 0 {
+		err = start()
+	}
+	if part != nil {
+		if finishErr := finish(); err == nil {
+			err = finishErr
+		}
+	}
+	return names, err
+}
+
+// encodedCSVLen returns how many bytes record takes written as CSV as format
+// says.
+func encodedCSVLen(record []string, format CSVWriteOptions) int64 {
+	var b bytes.Buffer
+	if format.AlwaysQuote || loneEmptyField(record) {
+		w := bufio.NewWriter(&b)
+		writeQuoted(w, record, format)
+		w.Flush()
+	} else {
+		w := csv.NewWriter(&b)
+		w.Comma = format.Delimiter
+		w.UseCRLF = format.UseCRLF
+		w.Write(record)
+		w.Flush()
+	}
+	return int64(b.Len())
+}
+
+// WriteGzipCSV is WriteCSV, but gzips what it writes to w. The gzip stream is
+// finished before it returns, though w is left open.
+func WriteGzipCSV(w io.Writer, format CSVWriteOptions, records <-chan CSVRecord) error {
+	gzwriter := gzip.NewWriter(w)
+	err := WriteCSV(gzwriter, format, records)
+	if closeErr := gzwriter.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}